@@ -0,0 +1,53 @@
+package opensmtpd
+
+import "io"
+
+/*
+ * Interfaces a filter can implement besides the event receivers, which are
+ * generated from events.json into filter_api_interfaces.go and
+ * report_api_interfaces.go.
+ */
+
+type ConfigReceiver interface {
+	Config([]string)
+}
+
+/*
+ * Lets a filter choose the subsystems ("smtp-in", "smtp-out") each of its
+ * handlers is registered for. eventType is "report" or "filter". Filters
+ * that don't implement it are registered for smtp-in only.
+ */
+type SubsystemSelector interface {
+	Subsystems(eventType, event string) []string
+}
+
+type MessageReceivedCallback interface {
+	/*
+		MessageReceivedCallback is a custom callback that the message has been
+		transmitted completely and the "." end of message marker has been
+		received by the filter wrapper. Any implementation *must* flush the
+		message back to OpenSMTPD via ``FilterEvent.Responder().FlushMessage()``
+		or the message will be lost. The session is a snapshot, so it can be
+		used from another goroutine after the callback has returned.
+	*/
+	MessageComplete(*FilterEvent, *SMTPSession)
+}
+
+type MessageStreamHandler interface {
+	/*
+		HandleMessageStream is called on its own goroutine when the first
+		line of a message arrives, instead of collecting the message for
+		MessageComplete. r returns the dot-unescaped message with CRLF line
+		endings while the client sends it, and what is written to w, with
+		"\n" or "\r\n" line endings, is sent back as the message. Lines
+		left in r when it returns are dropped. Returning an error rejects
+		the message at commit, with the error's reply if it is a
+		ReplyError. The session is a snapshot taken at the first line.
+		Takes precedence over MessageComplete.
+	*/
+	HandleMessageStream(session *SMTPSession, r io.Reader, w io.Writer) error
+}
+
+type TxBeginCallback interface {
+	TxBeginCallback(string, *SMTPSession)
+}
@@ -0,0 +1,404 @@
+package opensmtpd
+
+import (
+	"bufio"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * Runs several filters in one process as if they were one. The chain
+ * registers the union of its members' capabilities and hands every event to
+ * the members that handle it, in order.
+ *
+ * For filter events the first member that doesn't proceed decides: a reject,
+ * disconnect or rewrite is passed on to OpenSMTPD and the remaining members
+ * aren't asked. If all members proceed, the chain proceeds, or answers junk
+ * if any member did. Members may answer later through FilterEvent.Defer();
+ * the chain asks the next member once they have, without holding up the
+ * goroutine that dispatched the event. If the event's deadline passes first,
+ * the Runtime answers with the deadline's verdict and the remaining members
+ * aren't asked.
+ *
+ * Data-lines are piped through the members: the lines one member writes
+ * back are the input of the next member, and only the output of the last
+ * one reaches OpenSMTPD.
+ */
+type Chain struct {
+	members []FilterWrapper
+	config  *Config
+
+	// the member holding the handlers added through OnFilter and OnReport
+	handlers *FilterWrapperImpl
+
+	table atomic.Pointer[chainTable]
+}
+
+/*
+ * The chain's own dispatch table and the members handling each event, by
+ * type, op and subsystem.
+ */
+type chainTable struct {
+	dispatch dispatchTable
+	members  map[string]map[string]map[string][]FilterWrapper
+}
+
+func NewChain(members ...FilterWrapper) *Chain {
+	return &Chain{
+		members: members,
+	}
+}
+
+/*
+ * Adds handler to a member at the end of the chain.
+ */
+func (c *Chain) OnFilter(event string, handler EventHandler, subsystems ...string) FilterWrapper {
+	c.handlerMember().OnFilter(event, handler, subsystems...)
+	return c
+}
+
+/*
+ * Like OnFilter, for report events.
+ */
+func (c *Chain) OnReport(event string, handler EventHandler, subsystems ...string) FilterWrapper {
+	c.handlerMember().OnReport(event, handler, subsystems...)
+	return c
+}
+
+func (c *Chain) handlerMember() *FilterWrapperImpl {
+	if c.handlers == nil {
+		c.handlers = &FilterWrapperImpl{}
+		c.members = append(c.members, c.handlers)
+	}
+	c.table.Store(nil)
+	return c.handlers
+}
+
+func (c *Chain) GetFilter() interface{} {
+	return c
+}
+
+func (c *Chain) GetConfig() *Config {
+	return c.config
+}
+
+func (c *Chain) GetCapabilities() FilterDispatchMap {
+	capabilities := make(FilterDispatchMap)
+	for _, m := range c.members {
+		for typ, handlers := range m.GetCapabilities() {
+			if capabilities[typ] == nil {
+				capabilities[typ] = make(map[string]EventHandler)
+			}
+			for op := range handlers {
+				switch {
+				case typ != "filter":
+					capabilities[typ][op] = c.dispatchReport
+				case op == "data-line":
+					capabilities[typ][op] = c.dispatchDataline
+				default:
+					capabilities[typ][op] = c.dispatchFilter
+				}
+			}
+		}
+	}
+	return capabilities
+}
+
+/*
+ * Returns the union of the members' subsystems for typ and op.
+ */
+func (c *Chain) GetSubsystems(typ, op string) []string {
+	var subsystems []string
+	seen := make(map[string]bool)
+	for _, m := range c.members {
+		if _, ok := m.GetCapabilities()[typ][op]; !ok {
+			continue
+		}
+		for _, subsystem := range m.GetSubsystems(typ, op) {
+			if !seen[subsystem] {
+				seen[subsystem] = true
+				subsystems = append(subsystems, subsystem)
+			}
+		}
+	}
+	return subsystems
+}
+
+func (c *Chain) Register(out EventResponder) {
+	table := c.newTable()
+	c.table.Store(table)
+	table.dispatch.register(out)
+}
+
+func (c *Chain) Dispatch(event FilterEvent) {
+	if handler, ok := c.chainTable().dispatch.lookup(event.GetType(), event.GetVerb(), event.GetSubsystem()); ok {
+		handler(c, event)
+	}
+}
+
+func (c *Chain) chainTable() *chainTable {
+	if table := c.table.Load(); table != nil {
+		return table
+	}
+	table := c.newTable()
+	c.table.Store(table)
+	return table
+}
+
+func (c *Chain) newTable() *chainTable {
+	table := &chainTable{
+		dispatch: newDispatchTable(c),
+		members:  make(map[string]map[string]map[string][]FilterWrapper),
+	}
+	for _, m := range c.members {
+		for typ, entries := range newDispatchTable(m) {
+			if table.members[typ] == nil {
+				table.members[typ] = make(map[string]map[string][]FilterWrapper)
+			}
+			for op, entry := range entries {
+				if table.members[typ][op] == nil {
+					table.members[typ][op] = make(map[string][]FilterWrapper)
+				}
+				for _, subsystem := range entry.subsystems {
+					table.members[typ][op][subsystem] = append(table.members[typ][op][subsystem], m)
+				}
+			}
+		}
+	}
+	return table
+}
+
+func (c *Chain) ProcessConfig(scanner *bufio.Scanner) error {
+	config := NewConfig()
+	for {
+		if !scanner.Scan() {
+			return scanError(scanner)
+		}
+		line := scanner.Text()
+		atoms := strings.Split(line, "|")
+		config.parseLine(atoms)
+		c.receiveConfigLine(atoms)
+
+		if line == "config|ready" {
+			c.setConfig(config)
+			return nil
+		}
+	}
+}
+
+func (c *Chain) receiveConfigLine(atoms []string) {
+	for _, m := range c.members {
+		if cf, ok := m.(configForwarder); ok {
+			cf.receiveConfigLine(atoms)
+		}
+	}
+}
+
+func (c *Chain) setConfig(config *Config) {
+	c.config = config
+	for _, m := range c.members {
+		if cf, ok := m.(configForwarder); ok {
+			cf.setConfig(config)
+		}
+	}
+}
+
+/*
+ * Returns the members that handle the event, in order.
+ */
+func (c *Chain) handlersOf(event FilterEvent) []FilterWrapper {
+	return c.chainTable().members[event.GetType()][event.GetVerb()][event.GetSubsystem()]
+}
+
+func (c *Chain) dispatchReport(_ FilterWrapper, event FilterEvent) {
+	for _, m := range c.handlersOf(event) {
+		m.Dispatch(event)
+	}
+}
+
+func (c *Chain) dispatchFilter(_ FilterWrapper, event FilterEvent) {
+	c.askMembers(c.handlersOf(event), event, event.Defer(), false, nil)
+}
+
+/*
+ * Hands event to the first of members. The member's answer continues the
+ * chain from whichever goroutine sends it, so a member that answers through
+ * Defer() doesn't block the handler that dispatched the event. junk and
+ * reports carry what the members before it answered.
+ *
+ * smtpd takes one filter-result per event, so the reports of all members
+ * are joined into one. If a member answered junk, the chain answers junk
+ * and logs the reports instead, as junk can't carry a message.
+ */
+func (c *Chain) askMembers(members []FilterWrapper, event FilterEvent, out DeferredResponder, junk bool, reports []string) {
+	select {
+	case <-out.Done():
+		// the Runtime has answered with the deadline's verdict
+		return
+	default:
+	}
+
+	if len(members) == 0 {
+		switch {
+		case junk:
+			for _, report := range reports {
+				log.Printf("report of session %s: %s", event.GetSessionId(), report)
+			}
+			_ = out.Junk()
+		case len(reports) > 0:
+			_ = out.Report(strings.Join(reports, "; "))
+		default:
+			out.Proceed()
+		}
+		return
+	}
+
+	step := &chainStep{
+		chain:   c,
+		members: members[1:],
+		event:   event,
+		out:     out,
+		junk:    junk,
+		reports: reports,
+	}
+	members[0].Dispatch(withPrinter(event, step))
+}
+
+func (c *Chain) dispatchDataline(_ FilterWrapper, event FilterEvent) {
+	c.forwardDataline(c.handlersOf(event), event)
+}
+
+/*
+ * Hands event to the first of members and pipes that member's output into
+ * the next one.
+ */
+func (c *Chain) forwardDataline(members []FilterWrapper, event FilterEvent) {
+	if len(members) == 0 {
+		return
+	}
+	if len(members) == 1 {
+		members[0].Dispatch(event)
+		return
+	}
+	next := &datalineForwarder{
+		chain:   c,
+		members: members[1:],
+		event:   event,
+	}
+	members[0].Dispatch(withPrinter(event, next))
+}
+
+/*
+ * Turns the filter-dataline responses of one member into data-line events
+ * for the next one.
+ */
+type datalineForwarder struct {
+	chain   *Chain
+	members []FilterWrapper
+	event   FilterEvent
+}
+
+func (df *datalineForwarder) SafePrintln(msg string) {
+	atoms := strings.SplitN(msg, "|", 4)
+	if len(atoms) < 4 || atoms[0] != "filter-dataline" {
+		printerOf(df.event).SafePrintln(msg)
+		return
+	}
+
+	in := df.event.GetAtoms()
+	line := make([]string, 0, 8)
+	line = append(line, in[:7]...)
+	line = append(line, atoms[3])
+	df.chain.forwardDataline(df.members, withAtoms(df.event, line))
+}
+
+/*
+ * Receives the filter-result a member sends for an event and asks the
+ * members after it, unless the member's answer decides the event.
+ */
+type chainStep struct {
+	chain   *Chain
+	members []FilterWrapper
+	event   FilterEvent
+	out     DeferredResponder
+	junk    bool
+	reports []string
+}
+
+func (cs *chainStep) SafePrintln(msg string) {
+	if !strings.HasPrefix(msg, "filter-result|") {
+		log.Printf("dropping unexpected response in chain: %s", msg)
+		return
+	}
+
+	junk, reports := cs.junk, cs.reports
+	switch resultVerb(msg) {
+	case "proceed":
+	case "junk":
+		junk = true
+	case "report":
+		// a copy, so steps never share the array
+		reports = append(reports[:len(reports):len(reports)], resultParam(msg))
+	default:
+		printerOf(cs.event).SafePrintln(msg)
+		return
+	}
+	cs.chain.askMembers(cs.members, cs.event, cs.out, junk, reports)
+}
+
+/*
+ * Returns the verb of a filter-result line.
+ */
+func resultVerb(line string) string {
+	atoms := strings.SplitN(line, "|", 5)
+	if len(atoms) < 4 {
+		return ""
+	}
+	return atoms[3]
+}
+
+/*
+ * Returns what follows the verb of a filter-result line.
+ */
+func resultParam(line string) string {
+	atoms := strings.SplitN(line, "|", 5)
+	if len(atoms) < 5 {
+		return ""
+	}
+	return atoms[4]
+}
+
+/*
+ * Returns a copy of event whose responses go to out.
+ */
+func withPrinter(event FilterEvent, out Printer) FilterEvent {
+	ev := &FilterEventImpl{
+		FilterEventData{
+			atoms:  event.GetAtoms(),
+			out:    out,
+			config: event.GetConfig(),
+			err:    event.GetError(),
+		},
+	}
+	if event.GetType() == "filter" && event.GetVerb() != "data-line" {
+		ev.pending = newPendingResponse(out, ev.atoms, nil)
+		ev.out = ev.pending
+	}
+	return ev
+}
+
+/*
+ * Returns a copy of event with different atoms that responds to the same
+ * printer.
+ */
+func withAtoms(event FilterEvent, atoms []string) FilterEvent {
+	return &FilterEventImpl{
+		FilterEventData{
+			atoms:  atoms,
+			out:    printerOf(event),
+			config: event.GetConfig(),
+			err:    event.GetError(),
+		},
+	}
+}
@@ -0,0 +1,156 @@
+package opensmtpd
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const rcptLine = "filter|0.7|1.5|smtp-in|rcpt-to|s1|t1|rcpt@example.org"
+
+func answering(answer func(EventResponder), asked *atomic.Int32) FilterWrapper {
+	return NewFilter(nil).OnFilter("rcpt-to", func(fw FilterWrapper, ev FilterEvent) {
+		asked.Add(1)
+		answer(ev.Responder())
+	})
+}
+
+/*
+ * Waits until out has n lines.
+ */
+func awaitLines(t *testing.T, out *linePrinter, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if lines := out.Lines(); len(lines) >= n {
+			return lines
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d lines, got %q", n, out.Lines())
+	return nil
+}
+
+func TestChainFilterResults(t *testing.T) {
+	proceed := func(r EventResponder) { r.Proceed() }
+	junk := func(r EventResponder) { _ = r.Junk() }
+	reject := func(r EventResponder) { r.HardReject("no") }
+	report := func(message string) func(EventResponder) {
+		return func(r EventResponder) { _ = r.Report(message) }
+	}
+
+	tests := []struct {
+		name    string
+		answers []func(EventResponder)
+		asked   []int32
+		want    string
+	}{
+		{"all proceed", []func(EventResponder){proceed, proceed}, []int32{1, 1}, "proceed"},
+		{"junk", []func(EventResponder){junk, proceed}, []int32{1, 1}, "junk"},
+		{"reject skips the rest", []func(EventResponder){proceed, reject, proceed}, []int32{1, 1, 0}, "reject|550 no"},
+		{"reports", []func(EventResponder){report("first"), proceed, report("second")}, []int32{1, 1, 1}, "report|first; second"},
+		{"report then junk", []func(EventResponder){report("first"), junk, proceed}, []int32{1, 1, 1}, "junk"},
+		{"junk then report", []func(EventResponder){junk, report("second")}, []int32{1, 1}, "junk"},
+		{"report then reject", []func(EventResponder){report("first"), reject}, []int32{1, 1}, "reject|550 no"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked := make([]atomic.Int32, len(tt.answers))
+			var members []FilterWrapper
+			for i, answer := range tt.answers {
+				members = append(members, answering(answer, &asked[i]))
+			}
+			out := &linePrinter{}
+			NewChain(members...).Dispatch(event(out, rcptLine))
+
+			for i := range asked {
+				if got := asked[i].Load(); got != tt.asked[i] {
+					t.Errorf("member %d was asked %d times, want %d", i, got, tt.asked[i])
+				}
+			}
+			if want := "filter-result|s1|t1|" + tt.want; strings.Join(out.Lines(), "\n") != want {
+				t.Errorf("got %q, want %q", out.Lines(), want)
+			}
+		})
+	}
+}
+
+func TestChainDoesNotBlockOnDeferredMembers(t *testing.T) {
+	release := make(chan struct{})
+	var asked atomic.Int32
+	first := NewFilter(nil).OnFilter("rcpt-to", func(fw FilterWrapper, ev FilterEvent) {
+		dr := ev.Defer()
+		go func() {
+			<-release
+			dr.Proceed()
+		}()
+	})
+	second := answering(func(r EventResponder) { r.SoftReject("later") }, &asked)
+
+	out := &linePrinter{}
+	returned := make(chan struct{})
+	go func() {
+		NewChain(first, second).Dispatch(event(out, rcptLine))
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the chain blocked on a deferred answer")
+	}
+	if asked.Load() != 0 || len(out.Lines()) != 0 {
+		t.Fatal("the chain went on before the first member answered")
+	}
+
+	close(release)
+	lines := awaitLines(t, out, 1)
+	if want := "filter-result|s1|t1|reject|451 later"; lines[0] != want {
+		t.Errorf("got %q, want %q", lines[0], want)
+	}
+}
+
+func TestChainStopsAtDeadline(t *testing.T) {
+	var asked atomic.Int32
+	first := NewFilter(nil).OnFilter("rcpt-to", func(fw FilterWrapper, ev FilterEvent) {
+		dr := ev.Defer()
+		go func() {
+			<-dr.Done()
+			dr.Proceed()
+		}()
+	})
+	second := answering(func(r EventResponder) { r.Proceed() }, &asked)
+
+	out := &linePrinter{}
+	ev := event(out, rcptLine).(*FilterEventImpl)
+	ev.pending = newPendingResponse(out, ev.atoms, &deadline{10 * time.Millisecond, VerdictSoftReject("timeout")})
+	ev.out = ev.pending
+	NewChain(first, second).Dispatch(ev)
+
+	lines := awaitLines(t, out, 1)
+	// give a late answer the chance to show up
+	time.Sleep(20 * time.Millisecond)
+	if want := "filter-result|s1|t1|reject|451 timeout"; len(out.Lines()) != 1 || lines[0] != want {
+		t.Errorf("got %q, want %q", out.Lines(), want)
+	}
+	if asked.Load() != 0 {
+		t.Error("a member was asked after the deadline")
+	}
+}
+
+func TestChainDispatchReportDoesNotAllocate(t *testing.T) {
+	var calls int
+	handler := func(fw FilterWrapper, ev FilterEvent) {
+		calls++
+	}
+	chain := NewChain(NewFilter(nil).OnReport("link-connect", handler), NewFilter(nil).OnReport("link-connect", handler))
+	chain.Register(NewEventResponder(NewFilterEvent(discardPrinter{}, []string{})))
+
+	ev := event(discardPrinter{}, "report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25")
+	if allocs := testing.AllocsPerRun(100, func() { chain.Dispatch(ev) }); allocs != 0 {
+		t.Errorf("dispatching a report allocated %v times", allocs)
+	}
+	if calls == 0 {
+		t.Error("the handlers weren't called")
+	}
+}
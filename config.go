@@ -0,0 +1,90 @@
+package opensmtpd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The configuration OpenSMTPD sends as config|<key>|<value> lines before a
+ * filter registers. Keys that don't have a field of their own are only
+ * available through Get.
+ */
+type Config struct {
+	SmtpdVersion    string
+	ProtocolVersion string
+	Subsystem       string
+	Admd            string
+	SessionTimeout  time.Duration
+
+	// every config|<key>|<value> pair, including the ones above
+	Values map[string]string
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Values: make(map[string]string),
+	}
+}
+
+func (c *Config) Get(key string) string {
+	return c.Values[key]
+}
+
+/*
+ * Records one config line. Returns false for lines that aren't
+ * config|<key>|<value>, like config|ready.
+ */
+func (c *Config) parseLine(atoms []string) bool {
+	if len(atoms) < 3 || atoms[0] != "config" {
+		return false
+	}
+
+	key := atoms[1]
+	value := strings.Join(atoms[2:], "|")
+	c.Values[key] = value
+
+	switch key {
+	case "smtpd-version":
+		c.SmtpdVersion = value
+	case "protocol":
+		c.ProtocolVersion = value
+	case "subsystem":
+		c.Subsystem = value
+	case "admd":
+		c.Admd = value
+	case "smtp-session-timeout":
+		if secs, err := strconv.Atoi(value); err == nil {
+			c.SessionTimeout = time.Duration(secs) * time.Second
+		}
+	}
+	return true
+}
+
+/*
+ * Compares two dotted protocol versions like "0.5" and "0.10" numerically
+ * and returns -1, 0 or 1.
+ */
+func compareVersions(a, b string) int {
+	for a != "" || b != "" {
+		var x, y string
+		x, a, _ = strings.Cut(a, ".")
+		y, b, _ = strings.Cut(b, ".")
+		if xi, yi := versionPart(x), versionPart(y); xi != yi {
+			if xi < yi {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionPart(s string) int {
+	if s == "" {
+		return 0
+	}
+	i, _ := strconv.Atoi(s)
+	return i
+}
@@ -0,0 +1,113 @@
+package opensmtpd
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type configFilter struct {
+	lines []string
+}
+
+func (f *configFilter) GetName() string {
+	return "config"
+}
+
+func (f *configFilter) Config(atoms []string) {
+	f.lines = append(f.lines, strings.Join(atoms, "|"))
+}
+
+func TestProcessConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		check func(*Config) bool
+	}{
+		{"smtpd version", []string{"config|smtpd-version|7.4.0"}, func(c *Config) bool {
+			return c.SmtpdVersion == "7.4.0" && c.Get("smtpd-version") == "7.4.0"
+		}},
+		{"protocol", []string{"config|protocol|0.7"}, func(c *Config) bool {
+			return c.ProtocolVersion == "0.7"
+		}},
+		{"subsystem", []string{"config|subsystem|smtp-in"}, func(c *Config) bool {
+			return c.Subsystem == "smtp-in"
+		}},
+		{"admd", []string{"config|admd|example.org"}, func(c *Config) bool {
+			return c.Admd == "example.org"
+		}},
+		{"session timeout", []string{"config|smtp-session-timeout|300"}, func(c *Config) bool {
+			return c.SessionTimeout == 5*time.Minute
+		}},
+		{"invalid session timeout", []string{"config|smtp-session-timeout|soon"}, func(c *Config) bool {
+			return c.SessionTimeout == 0 && c.Get("smtp-session-timeout") == "soon"
+		}},
+		{"unknown key", []string{"config|future-key|a|b"}, func(c *Config) bool {
+			return c.Get("future-key") == "a|b"
+		}},
+		{"later value wins", []string{"config|protocol|0.5", "config|protocol|0.6"}, func(c *Config) bool {
+			return c.ProtocolVersion == "0.6"
+		}},
+		{"not a key", []string{"config|no-value", "garbage"}, func(c *Config) bool {
+			return len(c.Values) == 0
+		}},
+		{"only ready", nil, func(c *Config) bool {
+			return len(c.Values) == 0 && c.ProtocolVersion == ""
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &configFilter{}
+			fw := NewFilter(f)
+			input := strings.Join(append(tt.lines, "config|ready", "filter|0.7|1.5|smtp-in|helo|s1|t1|x"), "\n")
+			scanner := bufio.NewScanner(strings.NewReader(input))
+			if err := fw.ProcessConfig(scanner); err != nil {
+				t.Fatal(err)
+			}
+			if c := fw.GetConfig(); c == nil || !tt.check(c) {
+				t.Errorf("unexpected config %+v", c)
+			}
+
+			// every line up to config|ready reaches the filter
+			if want := append(tt.lines, "config|ready"); strings.Join(f.lines, "\n") != strings.Join(want, "\n") {
+				t.Errorf("the filter got %q, want %q", f.lines, want)
+			}
+			// and the first event is left to the Runtime
+			if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "filter|") {
+				t.Error("ProcessConfig read past config|ready")
+			}
+		})
+	}
+}
+
+func TestProcessConfigWithoutReady(t *testing.T) {
+	fw := NewFilter(nil)
+	err := fw.ProcessConfig(bufio.NewScanner(strings.NewReader("config|protocol|0.7\n")))
+	if !errors.Is(err, ErrInputClosed) {
+		t.Errorf("expected ErrInputClosed, got %v", err)
+	}
+	if fw.GetConfig() != nil {
+		t.Error("the config was set without config|ready")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"0.5", "0.5", 0},
+		{"0.5", "0.6", -1},
+		{"0.10", "0.9", 1},
+		{"0.7", "0.7.0", 0},
+		{"1", "0.9", 1},
+		{"", "0.1", -1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package opensmtpd
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Answers a filter event on behalf of the filter when the filter didn't
+ * answer before the event's deadline.
+ */
+type Verdict func(EventResponder)
+
+func VerdictProceed() Verdict {
+	return func(r EventResponder) {
+		r.Proceed()
+	}
+}
+
+func VerdictSoftReject(response string) Verdict {
+	return func(r EventResponder) {
+		r.SoftReject(response)
+	}
+}
+
+type deadline struct {
+	timeout time.Duration
+	verdict Verdict
+}
+
+/*
+ * Answers filter events of the given phase (e.g. "rcpt-to") with verdict if
+ * the filter hasn't answered them within timeout. The timeout starts when
+ * the event is read, so it includes the time the event waited for a worker.
+ */
+func WithDeadline(phase string, timeout time.Duration, verdict Verdict) RuntimeOption {
+	return func(rt *Runtime) {
+		if rt.deadlines == nil {
+			rt.deadlines = make(map[string]deadline)
+		}
+		rt.deadlines[phase] = deadline{timeout, verdict}
+	}
+}
+
+/*
+ * Like WithDeadline, for all phases that don't have their own deadline.
+ */
+func WithDefaultDeadline(timeout time.Duration, verdict Verdict) RuntimeOption {
+	return func(rt *Runtime) {
+		rt.defaultDeadline = &deadline{timeout, verdict}
+	}
+}
+
+func (rt *Runtime) deadlineFor(phase string) *deadline {
+	if d, ok := rt.deadlines[phase]; ok {
+		return &d
+	}
+	return rt.defaultDeadline
+}
+
+/*
+ * Handed out by FilterEvent.Defer(). It answers the event like the
+ * EventResponder returned by Responder() and may be used from any
+ * goroutine, but only the first filter-result is passed on to OpenSMTPD.
+ */
+type DeferredResponder interface {
+	EventResponder
+	// The time at which the Runtime answers the event itself, if the
+	// event's phase has a deadline.
+	Deadline() (time.Time, bool)
+	// Closed once the event has been answered, either by the filter or
+	// because the deadline passed. nil for events that don't take a
+	// filter-result, i.e. reports and data-lines.
+	Done() <-chan struct{}
+}
+
+type deferredResponderImpl struct {
+	EventResponder
+	pending *pendingResponse
+}
+
+func (dr *deferredResponderImpl) Deadline() (time.Time, bool) {
+	if dr.pending == nil || dr.pending.deadline.IsZero() {
+		return time.Time{}, false
+	}
+	return dr.pending.deadline, true
+}
+
+func (dr *deferredResponderImpl) Done() <-chan struct{} {
+	if dr.pending == nil {
+		return nil
+	}
+	return dr.pending.done
+}
+
+/*
+ * Sits between a filter event and the Runtime's output and lets exactly one
+ * filter-result for the event through. If the event has a deadline, the
+ * Runtime answers with the deadline's verdict unless the filter was faster.
+ */
+type pendingResponse struct {
+	out      Printer
+	atoms    []string
+	deadline time.Time
+	timer    *time.Timer
+	done     chan struct{}
+
+	mu       sync.Mutex
+	answered bool
+}
+
+func newPendingResponse(out Printer, atoms []string, d *deadline) *pendingResponse {
+	p := &pendingResponse{
+		out:   out,
+		atoms: atoms,
+		done:  make(chan struct{}),
+	}
+	if d != nil {
+		p.deadline = time.Now().Add(d.timeout)
+		// the timer may fire before AfterFunc returns
+		p.mu.Lock()
+		p.timer = time.AfterFunc(d.timeout, func() {
+			p.expire(d.verdict)
+		})
+		p.mu.Unlock()
+	}
+	return p
+}
+
+func (p *pendingResponse) SafePrintln(msg string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.answered {
+		log.Printf("dropping response to an event that was already answered: %s", msg)
+		return
+	}
+	if strings.HasPrefix(msg, "filter-result|") {
+		p.finish()
+	}
+	p.out.SafePrintln(msg)
+}
+
+func (p *pendingResponse) expire(verdict Verdict) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.answered {
+		return
+	}
+	log.Printf("no response to %s|%s of session %s before the deadline",
+		p.atoms[0], p.atoms[4], p.atoms[5])
+	p.finish()
+	verdict(NewEventResponder(NewFilterEvent(p.out, p.atoms)))
+}
+
+func (p *pendingResponse) finish() {
+	p.answered = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	close(p.done)
+}
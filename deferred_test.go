@@ -0,0 +1,91 @@
+package opensmtpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDeadlineEvent(t *testing.T, out Printer, line string, opts ...RuntimeOption) *FilterEventImpl {
+	t.Helper()
+	ev, err := NewRuntime(nil, nil, nil, opts...).newEvent(out, line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestDeadlineAnswersWithVerdict(t *testing.T) {
+	out := &linePrinter{}
+	ev := newDeadlineEvent(t, out, rcptLine, WithDeadline("rcpt-to", 10*time.Millisecond, VerdictSoftReject("timeout")))
+	dr := ev.Defer()
+
+	select {
+	case <-dr.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the deadline didn't pass")
+	}
+	dr.Proceed()
+
+	want := "filter-result|s1|t1|reject|451 timeout"
+	if lines := out.Lines(); len(lines) != 1 || lines[0] != want {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestDeferredAnswerBeforeDeadline(t *testing.T) {
+	out := &linePrinter{}
+	ev := newDeadlineEvent(t, out, rcptLine, WithDeadline("rcpt-to", 10*time.Millisecond, VerdictSoftReject("timeout")))
+	dr := ev.Defer()
+
+	go dr.Proceed()
+	<-dr.Done()
+	// the verdict would have been sent by now
+	time.Sleep(20 * time.Millisecond)
+
+	want := "filter-result|s1|t1|proceed"
+	if lines := out.Lines(); len(lines) != 1 || lines[0] != want {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestDeadlineFor(t *testing.T) {
+	opts := []RuntimeOption{
+		WithDeadline("rcpt-to", time.Minute, VerdictProceed()),
+		WithDefaultDeadline(time.Hour, VerdictProceed()),
+	}
+	tests := []struct {
+		line    string
+		timeout time.Duration
+	}{
+		{rcptLine, time.Minute},
+		{"filter|0.7|1.5|smtp-in|helo|s1|t1|example.org", time.Hour},
+	}
+	for _, tt := range tests {
+		before := time.Now()
+		dr := newDeadlineEvent(t, discardPrinter{}, tt.line, opts...).Defer()
+		deadline, ok := dr.Deadline()
+		if !ok || deadline.Before(before.Add(tt.timeout)) || deadline.After(time.Now().Add(tt.timeout)) {
+			t.Errorf("%s: unexpected deadline %v", tt.line, deadline)
+		}
+		dr.Proceed()
+	}
+
+	dr := newDeadlineEvent(t, discardPrinter{}, rcptLine).Defer()
+	if _, ok := dr.Deadline(); ok {
+		t.Error("an event without a deadline reported one")
+	}
+	dr.Proceed()
+}
+
+func TestEventsWithoutFilterResult(t *testing.T) {
+	for _, line := range []string{
+		"filter|0.7|1.5|smtp-in|data-line|s1|t1|line",
+		"report|0.7|1.5|smtp-in|link-disconnect|s1",
+	} {
+		dr := newDeadlineEvent(t, discardPrinter{}, line, WithDefaultDeadline(time.Millisecond, VerdictProceed())).Defer()
+		if _, ok := dr.Deadline(); ok || dr.Done() != nil {
+			t.Errorf("%s: expected no deadline", strings.SplitN(line, "|", 6)[4])
+		}
+	}
+}
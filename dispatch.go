@@ -0,0 +1,425 @@
+// Code generated by eventgen from events.json. DO NOT EDIT.
+
+package opensmtpd
+
+/*
+ * Every event a filter can receive by implementing the matching interface.
+ */
+var eventTable = []eventEntry{
+	{
+		typ:  "report",
+		name: "link-connect",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(LinkConnectReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(LinkConnectReceiver).LinkConnect(fw, ev)
+		},
+		layout: eventLayout{params: 4},
+	},
+	{
+		typ:  "report",
+		name: "link-disconnect",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(LinkDisconnectReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(LinkDisconnectReceiver).LinkDisconnect(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "report",
+		name: "link-greeting",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(LinkGreetingReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(LinkGreetingReceiver).LinkGreeting(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "report",
+		name: "link-identify",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(LinkIdentifyReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(LinkIdentifyReceiver).LinkIdentify(fw, ev)
+		},
+		layout: eventLayout{params: 2, text: true, legacy: "0.5", legacyParams: 1},
+	},
+	{
+		typ:  "report",
+		name: "link-tls",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(LinkTLSReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(LinkTLSReceiver).LinkTLS(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "report",
+		name: "link-auth",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(LinkAuthReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(LinkAuthReceiver).LinkAuth(fw, ev)
+		},
+		layout: eventLayout{params: 2, text: true, legacy: "0.6", legacyParams: 2},
+	},
+	{
+		typ:  "report",
+		name: "tx-reset",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxResetReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxResetReceiver).TxReset(fw, ev)
+		},
+		layout: eventLayout{params: 1},
+	},
+	{
+		typ:  "report",
+		name: "tx-begin",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxBeginReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxBeginReceiver).TxBegin(fw, ev)
+		},
+		layout: eventLayout{params: 1},
+	},
+	{
+		typ:  "report",
+		name: "tx-mail",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxMailReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxMailReceiver).TxMail(fw, ev)
+		},
+		layout: eventLayout{params: 3, text: true, legacy: "0.6", legacyParams: 3},
+	},
+	{
+		typ:  "report",
+		name: "tx-rcpt",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxRcptReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxRcptReceiver).TxRcpt(fw, ev)
+		},
+		layout: eventLayout{params: 3, text: true, legacy: "0.6", legacyParams: 3},
+	},
+	{
+		typ:  "report",
+		name: "tx-envelope",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxEnvelopeReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxEnvelopeReceiver).TxEnvelope(fw, ev)
+		},
+		layout: eventLayout{params: 2},
+	},
+	{
+		typ:  "report",
+		name: "tx-data",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxDataReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxDataReceiver).TxData(fw, ev)
+		},
+		layout: eventLayout{params: 2},
+	},
+	{
+		typ:  "report",
+		name: "tx-commit",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxCommitReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxCommitReceiver).TxCommit(fw, ev)
+		},
+		layout: eventLayout{params: 2},
+	},
+	{
+		typ:  "report",
+		name: "tx-rollback",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TxRollbackReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TxRollbackReceiver).TxRollback(fw, ev)
+		},
+		layout: eventLayout{params: 1},
+	},
+	{
+		typ:  "report",
+		name: "protocol-client",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(ProtocolClientReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(ProtocolClientReceiver).ProtocolClient(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "report",
+		name: "protocol-server",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(ProtocolServerReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(ProtocolServerReceiver).ProtocolServer(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "report",
+		name: "filter-report",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(FilterReportReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(FilterReportReceiver).FilterReport(fw, ev)
+		},
+		layout: eventLayout{params: 3, text: true},
+	},
+	{
+		typ:  "report",
+		name: "filter-response",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(FilterResponseReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(FilterResponseReceiver).FilterResponse(fw, ev)
+		},
+		layout: eventLayout{params: 3, text: true, optional: 1},
+	},
+	{
+		typ:  "report",
+		name: "timeout",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(TimeoutReceiver)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(TimeoutReceiver).Timeout(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "connect",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(ConnectFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(ConnectFilter).Connect(fw, ev)
+		},
+		layout: eventLayout{params: 2},
+	},
+	{
+		typ:  "filter",
+		name: "helo",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(HeloFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(HeloFilter).Helo(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "filter",
+		name: "ehlo",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(EhloFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(EhloFilter).Ehlo(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "filter",
+		name: "starttls",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(StartTLSFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(StartTLSFilter).StartTLS(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "auth",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(AuthFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(AuthFilter).Auth(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "filter",
+		name: "mail-from",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(MailFromFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(MailFromFilter).MailFrom(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "filter",
+		name: "rcpt-to",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(RcptToFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(RcptToFilter).RcptTo(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "filter",
+		name: "data",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(DataFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(DataFilter).Data(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "data-line",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(DatalineFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(DatalineFilter).Dataline(fw, ev)
+		},
+		layout: eventLayout{params: 1, text: true},
+	},
+	{
+		typ:  "filter",
+		name: "rset",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(RsetFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(RsetFilter).Rset(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "quit",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(QuitFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(QuitFilter).Quit(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "noop",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(NoopFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(NoopFilter).Noop(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "help",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(HelpFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(HelpFilter).Help(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "wiz",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(WizFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(WizFilter).Wiz(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+	{
+		typ:  "filter",
+		name: "commit",
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(CommitFilter)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(CommitFilter).Commit(fw, ev)
+		},
+		layout: eventLayout{},
+	},
+}
+
+// Filter phases that can be answered with a rewrite.
+var rewritablePhases = map[string]bool{
+	"helo":      true,
+	"ehlo":      true,
+	"mail-from": true,
+	"rcpt-to":   true,
+}
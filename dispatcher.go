@@ -0,0 +1,117 @@
+package opensmtpd
+
+import (
+	"context"
+	"sync"
+)
+
+// events that may be waiting for a free worker per worker, before reading
+// further input blocks
+const queuedEventsPerWorker = 1024
+
+/*
+ * Runs handlers on a bounded number of goroutines while keeping the events
+ * of each session in order. Every session with pending events gets its own
+ * goroutine that works through the session's queue and exits once the
+ * queue is empty. The semaphore limits how many handlers actually run.
+ */
+type sessionDispatcher struct {
+	fw      FilterWrapper
+	running chan struct{}
+	queued  chan struct{}
+	errc    chan error
+
+	mu      sync.Mutex
+	queues  map[string][]FilterEvent
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newSessionDispatcher(fw FilterWrapper, workers int) *sessionDispatcher {
+	return &sessionDispatcher{
+		fw:      fw,
+		running: make(chan struct{}, workers),
+		queued:  make(chan struct{}, workers*queuedEventsPerWorker),
+		errc:    make(chan error, 1),
+		queues:  make(map[string][]FilterEvent),
+	}
+}
+
+func (d *sessionDispatcher) submit(ctx context.Context, ev FilterEvent) error {
+	select {
+	case d.queued <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-d.errc:
+		return err
+	}
+
+	id := ev.GetSessionId()
+	d.mu.Lock()
+	queue, busy := d.queues[id]
+	d.queues[id] = append(queue, ev)
+	if !busy {
+		d.wg.Add(1)
+		go d.drain(id)
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *sessionDispatcher) drain(id string) {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		queue := d.queues[id]
+		if len(queue) == 0 || d.stopped {
+			delete(d.queues, id)
+			d.mu.Unlock()
+			return
+		}
+		ev := queue[0]
+		queue[0] = nil
+		d.queues[id] = queue[1:]
+		d.mu.Unlock()
+
+		d.running <- struct{}{}
+		err := dispatch(d.fw, ev)
+		<-d.running
+		<-d.queued
+
+		if err != nil {
+			d.fail(err)
+		}
+	}
+}
+
+func (d *sessionDispatcher) fail(err error) {
+	select {
+	case d.errc <- err:
+	default:
+		// an earlier error is already waiting to be reported
+	}
+}
+
+/*
+ * Waits until all queued events are handled and returns the first handler
+ * error, if any.
+ */
+func (d *sessionDispatcher) wait() error {
+	d.wg.Wait()
+	select {
+	case err := <-d.errc:
+		return err
+	default:
+		return nil
+	}
+}
+
+/*
+ * Drops all queued events and waits for the running handlers to return.
+ */
+func (d *sessionDispatcher) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+	d.wg.Wait()
+}
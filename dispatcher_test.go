@@ -0,0 +1,77 @@
+package opensmtpd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkersKeepSessionOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+	fw := NewFilter(nil).OnReport("protocol-client", func(fw FilterWrapper, ev FilterEvent) {
+		n, err := strconv.Atoi(ev.GetParams()[0])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// let other sessions overtake this one
+		if n%3 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		seen[ev.GetSessionId()] = append(seen[ev.GetSessionId()], n)
+		mu.Unlock()
+	})
+
+	var input strings.Builder
+	for n := 0; n < 20; n++ {
+		for s := 0; s < 10; s++ {
+			fmt.Fprintf(&input, "report|0.7|1.5|smtp-in|protocol-client|s%d|%d\n", s, n)
+		}
+	}
+	if _, err := runInput(t, fw, input.String(), WithWorkers(4)); !errors.Is(err, ErrInputClosed) {
+		t.Fatal(err)
+	}
+
+	if len(seen) != 10 {
+		t.Fatalf("expected 10 sessions, got %d", len(seen))
+	}
+	for id, order := range seen {
+		if len(order) != 20 {
+			t.Errorf("%s: expected 20 events, got %d", id, len(order))
+			continue
+		}
+		for i, n := range order {
+			if n != i {
+				t.Errorf("%s: events out of order: %v", id, order)
+				break
+			}
+		}
+	}
+}
+
+func TestWorkersHandleSessionsInParallel(t *testing.T) {
+	released := make(chan struct{})
+	fw := NewFilter(nil).OnReport("protocol-client", func(fw FilterWrapper, ev FilterEvent) {
+		switch ev.GetSessionId() {
+		case "blocked":
+			select {
+			case <-released:
+			case <-time.After(5 * time.Second):
+				t.Error("the other session wasn't handled while this one blocked")
+			}
+		case "free":
+			close(released)
+		}
+	})
+	input := "report|0.7|1.5|smtp-in|protocol-client|blocked|QUIT\n" +
+		"report|0.7|1.5|smtp-in|protocol-client|free|QUIT\n"
+	if _, err := runInput(t, fw, input, WithWorkers(2)); !errors.Is(err, ErrInputClosed) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+package opensmtpd
+
+import (
+	"fmt"
+)
+
+/*
+ * The handlers of a FilterWrapper with the subsystems they're registered
+ * for, built once so dispatching an event is just a few map lookups.
+ */
+type dispatchTable map[string]map[string]tableEntry
+
+type tableEntry struct {
+	handler    EventHandler
+	subsystems []string
+}
+
+func newDispatchTable(fw FilterWrapper) dispatchTable {
+	table := make(dispatchTable)
+	for typ, handlers := range fw.GetCapabilities() {
+		table[typ] = make(map[string]tableEntry, len(handlers))
+		for op, handler := range handlers {
+			table[typ][op] = tableEntry{
+				handler:    handler,
+				subsystems: fw.GetSubsystems(typ, op),
+			}
+		}
+	}
+	return table
+}
+
+/*
+ * Returns the handler for typ and op if it is registered for subsystem.
+ */
+func (dt dispatchTable) lookup(typ, op, subsystem string) (EventHandler, bool) {
+	entry, ok := dt[typ][op]
+	if !ok {
+		return nil, false
+	}
+	for _, s := range entry.subsystems {
+		if s == subsystem {
+			return entry.handler, true
+		}
+	}
+	return nil, false
+}
+
+/*
+ * Sends the register lines for every handler in the table.
+ */
+func (dt dispatchTable) register(out Printer) {
+	for typ := range dt {
+		for op, entry := range dt[typ] {
+			for _, subsystem := range entry.subsystems {
+				out.SafePrintln(fmt.Sprintf("register|%v|%v|%v", typ, subsystem, op))
+			}
+		}
+	}
+	out.SafePrintln("register|ready")
+}
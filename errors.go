@@ -0,0 +1,154 @@
+package opensmtpd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+ * Returned by RunContext when OpenSMTPD closes the filter's input. This is
+ * how smtpd tells a filter to shut down, so callers usually treat it as a
+ * clean exit.
+ */
+var ErrInputClosed = errors.New("opensmtpd: input closed")
+
+/*
+ * Returned by MIMEPart.AddFooter for signed or encrypted messages, which
+ * can't be changed without breaking them.
+ */
+var ErrSignedMessage = errors.New("opensmtpd: message is signed or encrypted")
+
+/*
+ * Returned by MIMEPart.AddFooter for messages without a text/plain or
+ * text/html body.
+ */
+var ErrNoTextPart = errors.New("opensmtpd: message has no text part")
+
+/*
+ * Returned by the event accessors when a line received from OpenSMTPD
+ * can't be understood. Runtime.Run doesn't return it, as a bad line
+ * doesn't stop the filter; see WithErrorHandler.
+ */
+type ProtocolError struct {
+	Line   string
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("opensmtpd: protocol error: %s: %q", e.Reason, e.Line)
+}
+
+func newProtocolError(atoms []string, reason string) *ProtocolError {
+	return &ProtocolError{
+		Line:   strings.Join(atoms, "|"),
+		Reason: reason,
+	}
+}
+
+/*
+ * Returned when an event handler panics. Value is whatever was passed to
+ * panic().
+ */
+type HandlerError struct {
+	Event FilterEvent
+	Value interface{}
+}
+
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("opensmtpd: handler for %s|%s failed: %v",
+		e.Event.GetType(), e.Event.GetVerb(), e.Value)
+}
+
+func (e *HandlerError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+/*
+ * Returned by EventResponder methods when the response isn't allowed for
+ * the event, like a rewrite in the data phase. Phase is empty if the event
+ * isn't a filter event at all.
+ */
+type VerbError struct {
+	Verb  string
+	Phase string
+}
+
+func (e *VerbError) Error() string {
+	if e.Phase == "" {
+		return fmt.Sprintf("opensmtpd: %s is only allowed in response to filter events", e.Verb)
+	}
+	return fmt.Sprintf("opensmtpd: %s is not allowed in phase %s", e.Verb, e.Phase)
+}
+
+/*
+ * An error that carries the reply a client should get for it, like the
+ * errors a filter records for a message it will reject at commit.
+ */
+type ReplyError interface {
+	error
+	Reply() Reply
+}
+
+/*
+ * Returned by FilterEvent.GetError() for an event whose line was longer
+ * than the maximum line length and got cut off there. See
+ * WithMaxLineLength.
+ */
+type LineTooLongError struct {
+	Max int
+}
+
+func (e *LineTooLongError) Error() string {
+	return fmt.Sprintf("opensmtpd: line longer than %d bytes", e.Max)
+}
+
+func (e *LineTooLongError) Reply() Reply {
+	return Reply{
+		Code:     550,
+		Enhanced: "5.6.0",
+		Lines:    []string{"Message contains a line that is too long"},
+	}
+}
+
+/*
+ * Recorded as SMTPSession.MessageError for a message larger than
+ * MessageLimits.MaxSize.
+ */
+type MessageTooLargeError struct {
+	Max int64
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("opensmtpd: message larger than %d bytes", e.Max)
+}
+
+func (e *MessageTooLargeError) Reply() Reply {
+	return Reply{
+		Code:     552,
+		Enhanced: "5.3.4",
+		Lines:    []string{"Message size exceeds fixed maximum message size"},
+	}
+}
+
+/*
+ * Recorded as SMTPSession.MessageError for a session restored by
+ * SessionHolderImpl.SetStore in the middle of its message, whose first part
+ * was lost with the filter that received it.
+ */
+type MessageInterruptedError struct{}
+
+func (e *MessageInterruptedError) Error() string {
+	return "opensmtpd: the filter was restarted during the message"
+}
+
+func (e *MessageInterruptedError) Reply() Reply {
+	return Reply{
+		Code:     451,
+		Enhanced: "4.3.0",
+		Lines:    []string{"Message interrupted, please try again"},
+	}
+}
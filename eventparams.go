@@ -0,0 +1,190 @@
+package opensmtpd
+
+//go:generate go run ./internal/eventgen
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Reads the parameters of one event in order and remembers the first
+ * error, so the parse functions don't have to check after every field.
+ */
+type paramReader struct {
+	ev     FilterEvent
+	name   string
+	params []string
+	err    error
+}
+
+func newParamReader(ev FilterEvent, typ, name string) *paramReader {
+	p := &paramReader{
+		ev:   ev,
+		name: name,
+	}
+	if len(ev.GetAtoms()) < 6 || ev.GetType() != typ || ev.GetVerb() != name {
+		p.fail(fmt.Sprintf("not a %s|%s event", typ, name))
+		return p
+	}
+
+	p.params = ev.GetParams()
+	if typ == "filter" {
+		// GetParams() starts with the token for filter events
+		if len(p.params) == 0 {
+			p.fail("missing token")
+			return p
+		}
+		p.params = p.params[1:]
+	}
+	return p
+}
+
+/*
+ * Reports whether the event uses the parameter order of protocol versions
+ * before version.
+ */
+func (p *paramReader) before(version string) bool {
+	return p.err == nil && compareVersions(p.ev.GetProtocolVersion(), version) < 0
+}
+
+func (p *paramReader) fail(reason string) {
+	if p.err == nil {
+		p.err = newProtocolError(p.ev.GetAtoms(), reason)
+	}
+}
+
+func (p *paramReader) str(field string) string {
+	if p.err != nil {
+		return ""
+	}
+	if len(p.params) == 0 {
+		p.fail(fmt.Sprintf("%s: missing %s", p.name, field))
+		return ""
+	}
+	value := p.params[0]
+	p.params = p.params[1:]
+	return value
+}
+
+/*
+ * Reads a parameter that may contain "|" by joining everything except the
+ * last keep parameters.
+ */
+func (p *paramReader) rest(field string, keep int) string {
+	if p.err != nil {
+		return ""
+	}
+	if len(p.params) < keep+1 {
+		p.fail(fmt.Sprintf("%s: missing %s", p.name, field))
+		return ""
+	}
+	n := len(p.params) - keep
+	value := strings.Join(p.params[:n], "|")
+	p.params = p.params[n:]
+	return value
+}
+
+func (p *paramReader) int(field string) int {
+	value := p.str(field)
+	if p.err != nil {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		p.fail(fmt.Sprintf("%s: invalid %s %q", p.name, field, value))
+	}
+	return i
+}
+
+/*
+ * Reads an address as printed by smtpd. Unix sockets yield the zero
+ * AddrPort.
+ */
+func (p *paramReader) addr(field string) netip.AddrPort {
+	value := p.str(field)
+	if p.err != nil {
+		return netip.AddrPort{}
+	}
+	addr, err := parseAddrPort(value)
+	if err != nil {
+		p.fail(fmt.Sprintf("%s: invalid %s %q", p.name, field, value))
+	}
+	return addr
+}
+
+func parseAddrPort(value string) (netip.AddrPort, error) {
+	if strings.HasPrefix(value, "unix:") {
+		return netip.AddrPort{}, nil
+	}
+	if addr, err := netip.ParseAddrPort(value); err == nil {
+		return addr, nil
+	}
+
+	// fall back to splitting off the port ourselves, for IPv6 addresses
+	// without brackets or with an "IPv6:" prefix
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return netip.AddrPort{}, fmt.Errorf("missing port")
+	}
+	port, err := strconv.ParseUint(value[i+1:], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(value[:i], "["), "]")
+	host = strings.TrimPrefix(host, "IPv6:")
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+/*
+ * Reads an optional parameter that may contain "|".
+ */
+func (p *paramReader) optRest(field string) string {
+	if p.err != nil || len(p.params) == 0 {
+		return ""
+	}
+	return p.rest(field, 0)
+}
+
+// Parameters of the link-tls report.
+type LinkTLS struct {
+	Version string
+	Cipher  string
+	Bits    int
+}
+
+/*
+ * smtpd describes the TLS session as a single parameter like
+ * "version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256".
+ */
+func parseLinkTLS(ev FilterEvent) (LinkTLS, error) {
+	var e LinkTLS
+	p := newParamReader(ev, "report", "link-tls")
+	tls := p.rest("tls-string", 0)
+	if p.err != nil {
+		return e, p.err
+	}
+
+	for _, field := range strings.Split(tls, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "version":
+			e.Version = value
+		case "cipher":
+			e.Cipher = value
+		case "bits":
+			bits, err := strconv.Atoi(value)
+			if err != nil {
+				p.fail(fmt.Sprintf("link-tls: invalid bits %q", value))
+			}
+			e.Bits = bits
+		}
+	}
+	return e, p.err
+}
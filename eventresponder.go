@@ -2,6 +2,8 @@ package opensmtpd
 
 import (
 	"fmt"
+	"log"
+	"strconv"
 	"strings"
 )
 
@@ -10,6 +12,15 @@ type EventResponder interface {
 	HardReject(response string)
 	SoftReject(response string)
 	Greylist(response string)
+	Rewrite(param string) error
+	Disconnect(response string) error
+	Junk() error
+	Report(message string) error
+	Reject(reply Reply) error
+	HardRejectReply(reply Reply) error
+	SoftRejectReply(reply Reply) error
+	GreylistReply(reply Reply) error
+	DisconnectReply(reply Reply) error
 	DatalineReply(line string)
 	DatalineEnd()
 	WriteMultilineHeader(header, value string)
@@ -19,7 +30,7 @@ type EventResponder interface {
 }
 
 type EventResponderImpl struct {
-	SafePrinter
+	Printer
 	event FilterEvent
 }
 
@@ -27,24 +38,196 @@ func (evr *EventResponderImpl) Proceed() {
 	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(), "%s", "proceed")
 }
 
+/*
+ * HardReject, Greylist and SoftReject replace line breaks in response with
+ * spaces, as they can't return an error.
+ */
 func (evr *EventResponderImpl) HardReject(response string) {
 	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(),
-		"reject|550 %s", response)
+		"reject|550 %s", flattenLine(response))
 }
 
 func (evr *EventResponderImpl) Greylist(response string) {
 	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(),
-		"reject|421 %s", response)
+		"reject|421 %s", flattenLine(response))
 }
 
 func (evr *EventResponderImpl) SoftReject(response string) {
 	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(),
-		"reject|451 %s", response)
+		"reject|451 %s", flattenLine(response))
 }
 
+var lineBreakReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+func flattenLine(s string) string {
+	return lineBreakReplacer.Replace(s)
+}
+
+/*
+ * Values written into a protocol line must not contain line breaks, which
+ * would end the line and start a forged one.
+ */
+func checkLine(what, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("opensmtpd: %s %q contains a line break", what, value)
+	}
+	return nil
+}
+
+/*
+ * Replaces the parameter of the current command (the HELO/EHLO name or the
+ * MAIL FROM/RCPT TO address) with param before smtpd processes it.
+ * Returns an error if param contains a line break.
+ */
+func (evr *EventResponderImpl) Rewrite(param string) error {
+	if err := evr.checkVerb("rewrite"); err != nil {
+		return err
+	}
+	if err := checkLine("rewrite parameter", param); err != nil {
+		return err
+	}
+	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(),
+		"rewrite|%s", param)
+	return nil
+}
+
+/*
+ * Rejects the command with a 421 response and closes the connection.
+ * Returns an error if response contains a line break.
+ */
+func (evr *EventResponderImpl) Disconnect(response string) error {
+	if err := evr.checkVerb("disconnect"); err != nil {
+		return err
+	}
+	if err := checkLine("disconnect response", response); err != nil {
+		return err
+	}
+	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(),
+		"disconnect|421 %s", response)
+	return nil
+}
+
+/*
+ * Proceeds, but marks the session's messages as junk.
+ */
+func (evr *EventResponderImpl) Junk() error {
+	if err := evr.checkVerb("junk"); err != nil {
+		return err
+	}
+	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(), "%s", "junk")
+	return nil
+}
+
+/*
+ * Proceeds and has smtpd log message with a filter-report. Returns an
+ * error if message contains a line break.
+ */
+func (evr *EventResponderImpl) Report(message string) error {
+	if err := evr.checkVerb("report"); err != nil {
+		return err
+	}
+	if err := checkLine("report message", message); err != nil {
+		return err
+	}
+	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(),
+		"report|%s", message)
+	return nil
+}
+
+/*
+ * Rejects the command with any 4xx or 5xx reply.
+ */
+func (evr *EventResponderImpl) Reject(reply Reply) error {
+	return evr.respondWithReply("Reject", "reject", reply, "45")
+}
+
+/*
+ * Like HardReject, with a custom 5xx reply.
+ */
+func (evr *EventResponderImpl) HardRejectReply(reply Reply) error {
+	return evr.respondWithReply("HardRejectReply", "reject", reply, "5")
+}
+
+/*
+ * Like SoftReject, with a custom 4xx reply.
+ */
+func (evr *EventResponderImpl) SoftRejectReply(reply Reply) error {
+	return evr.respondWithReply("SoftRejectReply", "reject", reply, "4")
+}
+
+/*
+ * Like Greylist, with a custom 4xx reply.
+ */
+func (evr *EventResponderImpl) GreylistReply(reply Reply) error {
+	return evr.respondWithReply("GreylistReply", "reject", reply, "4")
+}
+
+/*
+ * Like Disconnect, with a custom 4xx or 5xx reply.
+ */
+func (evr *EventResponderImpl) DisconnectReply(reply Reply) error {
+	return evr.respondWithReply("DisconnectReply", "disconnect", reply, "45")
+}
+
+/*
+ * classes lists the first digits of the reply codes the method accepts.
+ */
+func (evr *EventResponderImpl) respondWithReply(method, verb string, reply Reply, classes string) error {
+	if err := reply.validate(); err != nil {
+		return err
+	}
+	if !strings.Contains(classes, strconv.Itoa(reply.Code/100)) {
+		return fmt.Errorf("opensmtpd: %s doesn't accept reply code %d", method, reply.Code)
+	}
+	if err := evr.checkVerb(verb); err != nil {
+		return err
+	}
+
+	evr.Respond("filter-result", evr.event.GetSessionId(), evr.event.GetToken(),
+		"%s|%s", verb, reply.String())
+	return nil
+}
+
+// the filter phases in which the parameter of the command can be rewritten
+func (evr *EventResponderImpl) checkVerb(verb string) error {
+	atoms := evr.event.GetAtoms()
+	if len(atoms) < 7 || evr.event.GetType() != "filter" {
+		return &VerbError{Verb: verb}
+	}
+
+	phase := evr.event.GetVerb()
+	// data-lines are answered with filter-dataline, not filter-result
+	if phase == "data-line" || (verb == "rewrite" && !rewritablePhases[phase]) {
+		return &VerbError{Verb: verb, Phase: phase}
+	}
+	return nil
+}
+
+/*
+ * Writes the message back and frees its Body. If the message was parsed
+ * with SMTPSession.ParsedMessage, it is written with the changes made to
+ * it. If a spilled message can't be read back, the error is logged and
+ * SessionTrackingMixin rejects the message at commit.
+ */
 func (evr *EventResponderImpl) FlushMessage(session *SMTPSession) {
-	for _, line := range session.Message {
-		evr.DatalineReply(line)
+	if session.parsed != nil {
+		for _, line := range session.parsed.appendLines(nil) {
+			evr.DatalineReply(line)
+		}
+		session.Body.Close()
+	} else if session.Body != nil {
+		err := session.Body.Each(func(line string) error {
+			evr.DatalineReply(line)
+			return nil
+		})
+		if err != nil {
+			log.Printf("flushing message of session %s: %v", session.Id, err)
+		}
+		session.Body.Close()
+	} else {
+		for _, line := range session.Message {
+			evr.DatalineReply(line)
+		}
 	}
 	evr.DatalineEnd()
 }
@@ -76,7 +259,7 @@ func (evr *EventResponderImpl) WriteMultilineHeader(header, value string) {
 
 func (evr *EventResponderImpl) Respond(msgType, sessionId, token, format string, params ...interface{}) {
 	var prefix string
-	if evr.event.GetProtocolVersion() > "0.5" {
+	if compareVersions(evr.protocolVersion(), "0.5") > 0 {
 		prefix = msgType + "|" + sessionId + "|" + token
 	} else {
 		prefix = msgType + "|" + token + "|" + sessionId
@@ -84,10 +267,36 @@ func (evr *EventResponderImpl) Respond(msgType, sessionId, token, format string,
 	evr.SafePrintln(prefix + "|" + fmt.Sprintf(format, params...))
 }
 
+/*
+ * Uses the protocol version from the config handshake if smtpd sent one and
+ * the event's version otherwise.
+ */
+func (evr *EventResponderImpl) protocolVersion() string {
+	if config := evr.event.GetConfig(); config != nil && config.ProtocolVersion != "" {
+		return config.ProtocolVersion
+	}
+	if len(evr.event.GetAtoms()) > 1 {
+		return evr.event.GetProtocolVersion()
+	}
+	return ""
+}
+
 func NewEventResponder(_event FilterEvent) EventResponder {
 	resp := EventResponderImpl{
-		event: _event,
+		Printer: printerOf(_event),
+		event:   _event,
 	}
 
 	return &resp
 }
+
+func printerOf(ev FilterEvent) Printer {
+	if p, ok := ev.(interface{ printer() Printer }); ok && p.printer() != nil {
+		return p.printer()
+	}
+	return discardPrinter{}
+}
+
+type discardPrinter struct{}
+
+func (discardPrinter) SafePrintln(string) {}
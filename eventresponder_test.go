@@ -0,0 +1,90 @@
+package opensmtpd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestResponderVerbs(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer func(EventResponder) error
+		want   string
+	}{
+		{"rewrite", func(r EventResponder) error { return r.Rewrite("other@example.org") }, "rewrite|other@example.org"},
+		{"disconnect", func(r EventResponder) error { return r.Disconnect("go away") }, "disconnect|421 go away"},
+		{"report", func(r EventResponder) error { return r.Report("looked fine") }, "report|looked fine"},
+		{"junk", func(r EventResponder) error { return r.Junk() }, "junk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &linePrinter{}
+			if err := tt.answer(event(out, rcptLine).Responder()); err != nil {
+				t.Fatal(err)
+			}
+			if want := "filter-result|s1|t1|" + tt.want; strings.Join(out.Lines(), "\n") != want {
+				t.Errorf("got %q, want %q", out.Lines(), want)
+			}
+		})
+	}
+}
+
+func TestResponderVerbsRejectLineBreaks(t *testing.T) {
+	forged := "a@b\nfilter-result|s1|t9|proceed"
+	tests := map[string]func(EventResponder) error{
+		"rewrite":    func(r EventResponder) error { return r.Rewrite(forged) },
+		"disconnect": func(r EventResponder) error { return r.Disconnect("bye\r") },
+		"report":     func(r EventResponder) error { return r.Report(forged) },
+	}
+	for name, answer := range tests {
+		t.Run(name, func(t *testing.T) {
+			out := &linePrinter{}
+			if err := answer(event(out, rcptLine).Responder()); err == nil {
+				t.Error("expected an error")
+			}
+			if lines := out.Lines(); len(lines) != 0 {
+				t.Errorf("unexpected output %q", lines)
+			}
+		})
+	}
+}
+
+func TestRejectsFlattenLineBreaks(t *testing.T) {
+	out := &linePrinter{}
+	event(out, rcptLine).Responder().HardReject("no\r\nfilter-result|s1|t9|proceed")
+	want := "filter-result|s1|t1|reject|550 no filter-result|s1|t9|proceed"
+	if lines := out.Lines(); len(lines) != 1 || lines[0] != want {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestCheckVerb(t *testing.T) {
+	tests := []struct {
+		line  string
+		verb  string
+		phase string
+		ok    bool
+	}{
+		{rcptLine, "rewrite", "", true},
+		{rcptLine, "report", "", true},
+		{"filter|0.7|1.5|smtp-in|helo|s1|t1|example.org", "rewrite", "", true},
+		{"filter|0.7|1.5|smtp-in|commit|s1|t1", "rewrite", "commit", false},
+		{"filter|0.7|1.5|smtp-in|commit|s1|t1", "disconnect", "", true},
+		{"filter|0.7|1.5|smtp-in|data-line|s1|t1|line", "junk", "data-line", false},
+		{"report|0.7|1.5|smtp-in|link-disconnect|s1", "report", "", false},
+	}
+	for _, tt := range tests {
+		err := NewEventResponder(event(discardPrinter{}, tt.line)).(*EventResponderImpl).checkVerb(tt.verb)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%s after %s: unexpected error %v", tt.verb, tt.line, err)
+			}
+			continue
+		}
+		var verbErr *VerbError
+		if !errors.As(err, &verbErr) || verbErr.Verb != tt.verb || verbErr.Phase != tt.phase {
+			t.Errorf("%s after %s: got %v, want a VerbError for phase %q", tt.verb, tt.line, err, tt.phase)
+		}
+	}
+}
@@ -0,0 +1,606 @@
+// Code generated by eventgen from events.json. DO NOT EDIT.
+
+package opensmtpd
+
+import (
+	"net/netip"
+)
+
+/*
+ * Parsed parameters of every report and filter event. Each accessor returns
+ * an error if the event is of a different kind or its parameters can't be
+ * parsed.
+ */
+type EventAccessors interface {
+	LinkConnect() (LinkConnect, error)
+	LinkDisconnect() (LinkDisconnect, error)
+	LinkGreeting() (LinkGreeting, error)
+	LinkIdentify() (LinkIdentify, error)
+	LinkTLS() (LinkTLS, error)
+	LinkAuth() (LinkAuth, error)
+	TxReset() (TxReset, error)
+	TxBegin() (TxBegin, error)
+	TxMail() (TxMail, error)
+	TxRcpt() (TxRcpt, error)
+	TxEnvelope() (TxEnvelope, error)
+	TxData() (TxData, error)
+	TxCommit() (TxCommit, error)
+	TxRollback() (TxRollback, error)
+	ProtocolClient() (ProtocolClient, error)
+	ProtocolServer() (ProtocolServer, error)
+	FilterReport() (FilterReport, error)
+	FilterResponse() (FilterResponse, error)
+	Timeout() (Timeout, error)
+	ConnectRequest() (ConnectRequest, error)
+	HeloRequest() (HeloRequest, error)
+	EhloRequest() (EhloRequest, error)
+	StartTLSRequest() (StartTLSRequest, error)
+	AuthRequest() (AuthRequest, error)
+	MailFromRequest() (MailFromRequest, error)
+	RcptToRequest() (RcptToRequest, error)
+	DataRequest() (DataRequest, error)
+	DatalineRequest() (DatalineRequest, error)
+	RsetRequest() (RsetRequest, error)
+	QuitRequest() (QuitRequest, error)
+	NoopRequest() (NoopRequest, error)
+	HelpRequest() (HelpRequest, error)
+	WizRequest() (WizRequest, error)
+	CommitRequest() (CommitRequest, error)
+}
+
+// Parameters of the link-connect report.
+type LinkConnect struct {
+	Rdns   string
+	FCrDNS string
+	Src    netip.AddrPort
+	Dest   netip.AddrPort
+}
+
+func parseLinkConnect(ev FilterEvent) (LinkConnect, error) {
+	var e LinkConnect
+	p := newParamReader(ev, "report", "link-connect")
+	e.Rdns = p.str("rdns")
+	e.FCrDNS = p.str("fcrdns")
+	e.Src = p.addr("src")
+	e.Dest = p.addr("dest")
+	return e, p.err
+}
+
+// Parameters of the link-disconnect report.
+type LinkDisconnect struct{}
+
+func parseLinkDisconnect(ev FilterEvent) (LinkDisconnect, error) {
+	var e LinkDisconnect
+	p := newParamReader(ev, "report", "link-disconnect")
+	return e, p.err
+}
+
+// Parameters of the link-greeting report.
+type LinkGreeting struct {
+	Hostname string
+}
+
+func parseLinkGreeting(ev FilterEvent) (LinkGreeting, error) {
+	var e LinkGreeting
+	p := newParamReader(ev, "report", "link-greeting")
+	e.Hostname = p.rest("hostname", 0)
+	return e, p.err
+}
+
+// Parameters of the link-identify report.
+type LinkIdentify struct {
+	Method   string
+	Hostname string
+}
+
+func parseLinkIdentify(ev FilterEvent) (LinkIdentify, error) {
+	var e LinkIdentify
+	p := newParamReader(ev, "report", "link-identify")
+	if p.before("0.5") {
+		e.Hostname = p.rest("hostname", 0)
+	} else {
+		e.Method = p.str("method")
+		e.Hostname = p.rest("hostname", 0)
+	}
+	return e, p.err
+}
+
+// Parameters of the link-auth report.
+type LinkAuth struct {
+	Result   string
+	Username string
+}
+
+func parseLinkAuth(ev FilterEvent) (LinkAuth, error) {
+	var e LinkAuth
+	p := newParamReader(ev, "report", "link-auth")
+	if p.before("0.6") {
+		e.Username = p.rest("username", 1)
+		e.Result = p.str("result")
+	} else {
+		e.Result = p.str("result")
+		e.Username = p.rest("username", 0)
+	}
+	return e, p.err
+}
+
+// Parameters of the tx-reset report.
+type TxReset struct {
+	MsgID string
+}
+
+func parseTxReset(ev FilterEvent) (TxReset, error) {
+	var e TxReset
+	p := newParamReader(ev, "report", "tx-reset")
+	e.MsgID = p.str("msgid")
+	return e, p.err
+}
+
+// Parameters of the tx-begin report.
+type TxBegin struct {
+	MsgID string
+}
+
+func parseTxBegin(ev FilterEvent) (TxBegin, error) {
+	var e TxBegin
+	p := newParamReader(ev, "report", "tx-begin")
+	e.MsgID = p.str("msgid")
+	return e, p.err
+}
+
+// Parameters of the tx-mail report.
+type TxMail struct {
+	MsgID   string
+	Result  string
+	Address string
+}
+
+func parseTxMail(ev FilterEvent) (TxMail, error) {
+	var e TxMail
+	p := newParamReader(ev, "report", "tx-mail")
+	if p.before("0.6") {
+		e.MsgID = p.str("msgid")
+		e.Address = p.rest("address", 1)
+		e.Result = p.str("result")
+	} else {
+		e.MsgID = p.str("msgid")
+		e.Result = p.str("result")
+		e.Address = p.rest("address", 0)
+	}
+	return e, p.err
+}
+
+// Parameters of the tx-rcpt report.
+type TxRcpt struct {
+	MsgID   string
+	Result  string
+	Address string
+}
+
+func parseTxRcpt(ev FilterEvent) (TxRcpt, error) {
+	var e TxRcpt
+	p := newParamReader(ev, "report", "tx-rcpt")
+	if p.before("0.6") {
+		e.MsgID = p.str("msgid")
+		e.Address = p.rest("address", 1)
+		e.Result = p.str("result")
+	} else {
+		e.MsgID = p.str("msgid")
+		e.Result = p.str("result")
+		e.Address = p.rest("address", 0)
+	}
+	return e, p.err
+}
+
+// Parameters of the tx-envelope report.
+type TxEnvelope struct {
+	MsgID      string
+	EnvelopeID string
+}
+
+func parseTxEnvelope(ev FilterEvent) (TxEnvelope, error) {
+	var e TxEnvelope
+	p := newParamReader(ev, "report", "tx-envelope")
+	e.MsgID = p.str("msgid")
+	e.EnvelopeID = p.str("evpid")
+	return e, p.err
+}
+
+// Parameters of the tx-data report.
+type TxData struct {
+	MsgID  string
+	Result string
+}
+
+func parseTxData(ev FilterEvent) (TxData, error) {
+	var e TxData
+	p := newParamReader(ev, "report", "tx-data")
+	e.MsgID = p.str("msgid")
+	e.Result = p.str("result")
+	return e, p.err
+}
+
+// Parameters of the tx-commit report.
+type TxCommit struct {
+	MsgID   string
+	MsgSize int
+}
+
+func parseTxCommit(ev FilterEvent) (TxCommit, error) {
+	var e TxCommit
+	p := newParamReader(ev, "report", "tx-commit")
+	e.MsgID = p.str("msgid")
+	e.MsgSize = p.int("msgsize")
+	return e, p.err
+}
+
+// Parameters of the tx-rollback report.
+type TxRollback struct {
+	MsgID string
+}
+
+func parseTxRollback(ev FilterEvent) (TxRollback, error) {
+	var e TxRollback
+	p := newParamReader(ev, "report", "tx-rollback")
+	e.MsgID = p.str("msgid")
+	return e, p.err
+}
+
+// Parameters of the protocol-client report.
+type ProtocolClient struct {
+	Command string
+}
+
+func parseProtocolClient(ev FilterEvent) (ProtocolClient, error) {
+	var e ProtocolClient
+	p := newParamReader(ev, "report", "protocol-client")
+	e.Command = p.rest("command", 0)
+	return e, p.err
+}
+
+// Parameters of the protocol-server report.
+type ProtocolServer struct {
+	Response string
+}
+
+func parseProtocolServer(ev FilterEvent) (ProtocolServer, error) {
+	var e ProtocolServer
+	p := newParamReader(ev, "report", "protocol-server")
+	e.Response = p.rest("response", 0)
+	return e, p.err
+}
+
+// Parameters of the filter-report report.
+type FilterReport struct {
+	Kind    string
+	Name    string
+	Message string
+}
+
+func parseFilterReport(ev FilterEvent) (FilterReport, error) {
+	var e FilterReport
+	p := newParamReader(ev, "report", "filter-report")
+	e.Kind = p.str("kind")
+	e.Name = p.str("name")
+	e.Message = p.rest("message", 0)
+	return e, p.err
+}
+
+// Parameters of the filter-response report.
+type FilterResponse struct {
+	Phase    string
+	Response string
+	Param    string
+}
+
+func parseFilterResponse(ev FilterEvent) (FilterResponse, error) {
+	var e FilterResponse
+	p := newParamReader(ev, "report", "filter-response")
+	e.Phase = p.str("phase")
+	e.Response = p.str("response")
+	e.Param = p.optRest("param")
+	return e, p.err
+}
+
+// Parameters of the timeout report.
+type Timeout struct{}
+
+func parseTimeout(ev FilterEvent) (Timeout, error) {
+	var e Timeout
+	p := newParamReader(ev, "report", "timeout")
+	return e, p.err
+}
+
+// Parameters of the connect filter request.
+type ConnectRequest struct {
+	Rdns string
+	Src  netip.AddrPort
+}
+
+func parseConnectRequest(ev FilterEvent) (ConnectRequest, error) {
+	var e ConnectRequest
+	p := newParamReader(ev, "filter", "connect")
+	e.Rdns = p.str("rdns")
+	e.Src = p.addr("src")
+	return e, p.err
+}
+
+// Parameters of the helo filter request.
+type HeloRequest struct {
+	Identity string
+}
+
+func parseHeloRequest(ev FilterEvent) (HeloRequest, error) {
+	var e HeloRequest
+	p := newParamReader(ev, "filter", "helo")
+	e.Identity = p.rest("identity", 0)
+	return e, p.err
+}
+
+// Parameters of the ehlo filter request.
+type EhloRequest struct {
+	Identity string
+}
+
+func parseEhloRequest(ev FilterEvent) (EhloRequest, error) {
+	var e EhloRequest
+	p := newParamReader(ev, "filter", "ehlo")
+	e.Identity = p.rest("identity", 0)
+	return e, p.err
+}
+
+// Parameters of the starttls filter request.
+type StartTLSRequest struct{}
+
+func parseStartTLSRequest(ev FilterEvent) (StartTLSRequest, error) {
+	var e StartTLSRequest
+	p := newParamReader(ev, "filter", "starttls")
+	return e, p.err
+}
+
+// Parameters of the auth filter request.
+type AuthRequest struct {
+	Method string
+}
+
+func parseAuthRequest(ev FilterEvent) (AuthRequest, error) {
+	var e AuthRequest
+	p := newParamReader(ev, "filter", "auth")
+	e.Method = p.rest("method", 0)
+	return e, p.err
+}
+
+// Parameters of the mail-from filter request.
+type MailFromRequest struct {
+	Address string
+}
+
+func parseMailFromRequest(ev FilterEvent) (MailFromRequest, error) {
+	var e MailFromRequest
+	p := newParamReader(ev, "filter", "mail-from")
+	e.Address = p.rest("address", 0)
+	return e, p.err
+}
+
+// Parameters of the rcpt-to filter request.
+type RcptToRequest struct {
+	Address string
+}
+
+func parseRcptToRequest(ev FilterEvent) (RcptToRequest, error) {
+	var e RcptToRequest
+	p := newParamReader(ev, "filter", "rcpt-to")
+	e.Address = p.rest("address", 0)
+	return e, p.err
+}
+
+// Parameters of the data filter request.
+type DataRequest struct{}
+
+func parseDataRequest(ev FilterEvent) (DataRequest, error) {
+	var e DataRequest
+	p := newParamReader(ev, "filter", "data")
+	return e, p.err
+}
+
+// Parameters of the data-line filter request.
+type DatalineRequest struct {
+	Line string
+}
+
+func parseDatalineRequest(ev FilterEvent) (DatalineRequest, error) {
+	var e DatalineRequest
+	p := newParamReader(ev, "filter", "data-line")
+	e.Line = p.rest("line", 0)
+	return e, p.err
+}
+
+// Parameters of the rset filter request.
+type RsetRequest struct{}
+
+func parseRsetRequest(ev FilterEvent) (RsetRequest, error) {
+	var e RsetRequest
+	p := newParamReader(ev, "filter", "rset")
+	return e, p.err
+}
+
+// Parameters of the quit filter request.
+type QuitRequest struct{}
+
+func parseQuitRequest(ev FilterEvent) (QuitRequest, error) {
+	var e QuitRequest
+	p := newParamReader(ev, "filter", "quit")
+	return e, p.err
+}
+
+// Parameters of the noop filter request.
+type NoopRequest struct{}
+
+func parseNoopRequest(ev FilterEvent) (NoopRequest, error) {
+	var e NoopRequest
+	p := newParamReader(ev, "filter", "noop")
+	return e, p.err
+}
+
+// Parameters of the help filter request.
+type HelpRequest struct{}
+
+func parseHelpRequest(ev FilterEvent) (HelpRequest, error) {
+	var e HelpRequest
+	p := newParamReader(ev, "filter", "help")
+	return e, p.err
+}
+
+// Parameters of the wiz filter request.
+type WizRequest struct{}
+
+func parseWizRequest(ev FilterEvent) (WizRequest, error) {
+	var e WizRequest
+	p := newParamReader(ev, "filter", "wiz")
+	return e, p.err
+}
+
+// Parameters of the commit filter request.
+type CommitRequest struct{}
+
+func parseCommitRequest(ev FilterEvent) (CommitRequest, error) {
+	var e CommitRequest
+	p := newParamReader(ev, "filter", "commit")
+	return e, p.err
+}
+
+func (freq *FilterEventImpl) LinkConnect() (LinkConnect, error) {
+	return parseLinkConnect(freq)
+}
+
+func (freq *FilterEventImpl) LinkDisconnect() (LinkDisconnect, error) {
+	return parseLinkDisconnect(freq)
+}
+
+func (freq *FilterEventImpl) LinkGreeting() (LinkGreeting, error) {
+	return parseLinkGreeting(freq)
+}
+
+func (freq *FilterEventImpl) LinkIdentify() (LinkIdentify, error) {
+	return parseLinkIdentify(freq)
+}
+
+func (freq *FilterEventImpl) LinkTLS() (LinkTLS, error) {
+	return parseLinkTLS(freq)
+}
+
+func (freq *FilterEventImpl) LinkAuth() (LinkAuth, error) {
+	return parseLinkAuth(freq)
+}
+
+func (freq *FilterEventImpl) TxReset() (TxReset, error) {
+	return parseTxReset(freq)
+}
+
+func (freq *FilterEventImpl) TxBegin() (TxBegin, error) {
+	return parseTxBegin(freq)
+}
+
+func (freq *FilterEventImpl) TxMail() (TxMail, error) {
+	return parseTxMail(freq)
+}
+
+func (freq *FilterEventImpl) TxRcpt() (TxRcpt, error) {
+	return parseTxRcpt(freq)
+}
+
+func (freq *FilterEventImpl) TxEnvelope() (TxEnvelope, error) {
+	return parseTxEnvelope(freq)
+}
+
+func (freq *FilterEventImpl) TxData() (TxData, error) {
+	return parseTxData(freq)
+}
+
+func (freq *FilterEventImpl) TxCommit() (TxCommit, error) {
+	return parseTxCommit(freq)
+}
+
+func (freq *FilterEventImpl) TxRollback() (TxRollback, error) {
+	return parseTxRollback(freq)
+}
+
+func (freq *FilterEventImpl) ProtocolClient() (ProtocolClient, error) {
+	return parseProtocolClient(freq)
+}
+
+func (freq *FilterEventImpl) ProtocolServer() (ProtocolServer, error) {
+	return parseProtocolServer(freq)
+}
+
+func (freq *FilterEventImpl) FilterReport() (FilterReport, error) {
+	return parseFilterReport(freq)
+}
+
+func (freq *FilterEventImpl) FilterResponse() (FilterResponse, error) {
+	return parseFilterResponse(freq)
+}
+
+func (freq *FilterEventImpl) Timeout() (Timeout, error) {
+	return parseTimeout(freq)
+}
+
+func (freq *FilterEventImpl) ConnectRequest() (ConnectRequest, error) {
+	return parseConnectRequest(freq)
+}
+
+func (freq *FilterEventImpl) HeloRequest() (HeloRequest, error) {
+	return parseHeloRequest(freq)
+}
+
+func (freq *FilterEventImpl) EhloRequest() (EhloRequest, error) {
+	return parseEhloRequest(freq)
+}
+
+func (freq *FilterEventImpl) StartTLSRequest() (StartTLSRequest, error) {
+	return parseStartTLSRequest(freq)
+}
+
+func (freq *FilterEventImpl) AuthRequest() (AuthRequest, error) {
+	return parseAuthRequest(freq)
+}
+
+func (freq *FilterEventImpl) MailFromRequest() (MailFromRequest, error) {
+	return parseMailFromRequest(freq)
+}
+
+func (freq *FilterEventImpl) RcptToRequest() (RcptToRequest, error) {
+	return parseRcptToRequest(freq)
+}
+
+func (freq *FilterEventImpl) DataRequest() (DataRequest, error) {
+	return parseDataRequest(freq)
+}
+
+func (freq *FilterEventImpl) DatalineRequest() (DatalineRequest, error) {
+	return parseDatalineRequest(freq)
+}
+
+func (freq *FilterEventImpl) RsetRequest() (RsetRequest, error) {
+	return parseRsetRequest(freq)
+}
+
+func (freq *FilterEventImpl) QuitRequest() (QuitRequest, error) {
+	return parseQuitRequest(freq)
+}
+
+func (freq *FilterEventImpl) NoopRequest() (NoopRequest, error) {
+	return parseNoopRequest(freq)
+}
+
+func (freq *FilterEventImpl) HelpRequest() (HelpRequest, error) {
+	return parseHelpRequest(freq)
+}
+
+func (freq *FilterEventImpl) WizRequest() (WizRequest, error) {
+	return parseWizRequest(freq)
+}
+
+func (freq *FilterEventImpl) CommitRequest() (CommitRequest, error) {
+	return parseCommitRequest(freq)
+}
@@ -20,13 +20,14 @@
 package opensmtpd
 
 import (
-	"bufio"
-
+	"context"
+	"errors"
 	"fmt"
 	"log"
-
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -46,28 +47,64 @@ type EventHandler = func(FilterWrapper, FilterEvent)
  */
 type FilterDispatchMap = map[string]map[string]EventHandler
 
+const (
+	SubsystemSmtpIn  = "smtp-in"
+	SubsystemSmtpOut = "smtp-out"
+)
+
 type FilterEventData struct {
-	atoms []string
+	atoms   []string
+	out     Printer
+	pending *pendingResponse
+	config  *Config
+	err     error
 }
 
 type FilterEvent interface {
 	GetAtoms() []string
+	GetType() string
 	GetProtocolVersion() string
+	GetTimestamp() time.Time
+	GetSubsystem() string
 	GetVerb() string
 	GetSessionId() string
 	GetToken() string
 	GetParams() []string
+	GetConfig() *Config
+	GetError() error
 	Responder() EventResponder
+	Defer() DeferredResponder
+	EventAccessors
 }
 
 type FilterEventImpl struct {
 	FilterEventData
 }
 
+func (freq FilterEventImpl) GetType() string {
+	return freq.atoms[0]
+}
+
 func (freq FilterEventImpl) GetProtocolVersion() string {
 	return freq.atoms[1]
 }
 
+/*
+ * Returns the time at which smtpd generated the event, or the zero time if
+ * the timestamp can't be parsed.
+ */
+func (freq FilterEventImpl) GetTimestamp() time.Time {
+	ts, err := parseTimestamp(freq.atoms[2])
+	if err != nil {
+		return time.Time{}
+	}
+	return ts
+}
+
+func (freq FilterEventImpl) GetSubsystem() string {
+	return freq.atoms[3]
+}
+
 func (freq FilterEventImpl) GetVerb() string {
 	return freq.atoms[4]
 }
@@ -88,6 +125,22 @@ func (freq FilterEventImpl) GetParams() []string {
 	}
 }
 
+/*
+ * Returns the configuration OpenSMTPD sent before the filter registered.
+ * Never nil for events created by a Runtime.
+ */
+func (freq FilterEventImpl) GetConfig() *Config {
+	return freq.config
+}
+
+/*
+ * Returns why the event wasn't received completely, like a
+ * *LineTooLongError for a data-line that was cut off, or nil.
+ */
+func (freq FilterEventImpl) GetError() error {
+	return freq.err
+}
+
 func (freq FilterEventImpl) GetAtoms() []string {
 	return freq.atoms
 }
@@ -96,56 +149,101 @@ func (freq *FilterEventImpl) Responder() EventResponder {
 	return NewEventResponder(freq)
 }
 
-func NewFilterEvent(_atoms []string) FilterEvent {
+/*
+ * Returns a responder that can answer the event later from another
+ * goroutine, after the handler has returned.
+ */
+func (freq *FilterEventImpl) Defer() DeferredResponder {
+	return &deferredResponderImpl{
+		EventResponder: NewEventResponder(freq),
+		pending:        freq.pending,
+	}
+}
+
+func (freq *FilterEventImpl) printer() Printer {
+	return freq.out
+}
+
+/*
+ * Creates an event from the |-separated atoms of a protocol line. Responses
+ * to the event are written to out.
+ */
+func NewFilterEvent(out Printer, _atoms []string) FilterEvent {
 	ev := FilterEventImpl{
 		FilterEventData{
 			atoms: _atoms,
+			out:   out,
 		},
 	}
 
 	return &ev
 }
 
-func NewFilter(filter Filter) FilterWrapper {
-	return &FilterWrapperImpl{
-		Filter: filter,
+/*
+ * Parses timestamps like "1576146008.006099" without going through a
+ * float64, which would lose the microseconds.
+ */
+func parseTimestamp(ts string) (time.Time, error) {
+	secs, frac, hasFrac := strings.Cut(ts, ".")
+	if !isDigits(secs) || (hasFrac && !isDigits(frac)) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", ts)
 	}
-}
-
-var stdoutChannel = make(chan string)
-
-func stdoutWriter(out <-chan string) {
-	for str := range out {
-		fmt.Print(str)
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", ts)
 	}
-}
-
-type SafePrinter struct{}
 
-func (sp *SafePrinter) SafePrintln(msg string) {
-	stdoutChannel <- msg + "\n"
+	var nsec int64
+	if hasFrac {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nsec, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", ts)
+		}
+	}
+	return time.Unix(sec, nsec), nil
 }
 
-func Run(fw FilterWrapper) {
-	// start the stdout writer goroutine so we can write thread safe
-	go stdoutWriter(stdoutChannel)
-
-	scanner := bufio.NewScanner(os.Stdin)
-
-	fw.ProcessConfig(scanner)
-	fw.Register(NewEventResponder(NewFilterEvent([]string{})))
-
-	for {
-		if !scanner.Scan() {
-			log.Println("Scanner closed")
-			os.Exit(0)
+/*
+ * Reports whether s is a non-empty string of ASCII digits.
+ */
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
 		}
+	}
+	return true
+}
 
-		atoms := strings.Split(scanner.Text(), "|")
-		if len(atoms) < 6 {
-			log.Fatal("Less than 6 atoms")
-		}
+func NewFilter(filter Filter) FilterWrapper {
+	return &FilterWrapperImpl{
+		Filter: filter,
+	}
+}
 
-		fw.Dispatch(atoms)
+/*
+ * Runs the filter on stdin and stdout until OpenSMTPD closes stdin and then
+ * exits the process. Use RunContext if the filter is embedded in a larger
+ * program.
+ */
+func Run(fw FilterWrapper, opts ...RuntimeOption) {
+	err := RunContext(context.Background(), fw, opts...)
+	if errors.Is(err, ErrInputClosed) {
+		log.Println("Scanner closed")
+		os.Exit(0)
 	}
+	log.Fatal(err)
+}
+
+/*
+ * Runs the filter on stdin and stdout. See Runtime.Run.
+ */
+func RunContext(ctx context.Context, fw FilterWrapper, opts ...RuntimeOption) error {
+	return NewRuntime(fw, os.Stdin, os.Stdout, opts...).Run(ctx)
 }
@@ -0,0 +1,65 @@
+package opensmtpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetTimestamp(t *testing.T) {
+	tests := []struct {
+		ts   string
+		want time.Time
+	}{
+		{"1576146008", time.Unix(1576146008, 0)},
+		{"1576146008.006099", time.Unix(1576146008, 6099000)},
+		{"1576146008.5", time.Unix(1576146008, 500000000)},
+		{"1576146008.1234567891", time.Unix(1576146008, 123456789)},
+		{"1576146008.-5", time.Time{}},
+		{"1576146008.+5", time.Time{}},
+		{"1576146008.", time.Time{}},
+		{"1576146008.5x", time.Time{}},
+		{"-1576146008", time.Time{}},
+		{".5", time.Time{}},
+		{"", time.Time{}},
+	}
+	for _, tt := range tests {
+		ev := event(discardPrinter{}, "report|0.7|"+tt.ts+"|smtp-in|link-disconnect|s1")
+		if got := ev.GetTimestamp(); !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestFilterEventAccessors(t *testing.T) {
+	out := &linePrinter{}
+	ev := event(out, "filter|0.6|1.5|smtp-out|rcpt-to|s1|t1|rcpt@example.org")
+	got := []string{ev.GetType(), ev.GetProtocolVersion(), ev.GetSubsystem(), ev.GetVerb(), ev.GetSessionId(), ev.GetToken()}
+	if want := []string{"filter", "0.6", "smtp-out", "rcpt-to", "s1", "t1"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// the parameters of filter events start with the token
+	if params := ev.GetParams(); len(params) != 2 || params[1] != "rcpt@example.org" {
+		t.Errorf("unexpected params %q", params)
+	}
+	if req, err := ev.RcptToRequest(); err != nil || req.Address != "rcpt@example.org" {
+		t.Errorf("unexpected request %+v, %v", req, err)
+	}
+
+	ev.Responder().Proceed()
+	if lines := out.Lines(); len(lines) != 1 || lines[0] != "filter-result|s1|t1|proceed" {
+		t.Errorf("the response didn't go to the event's printer: %q", lines)
+	}
+
+	report := event(out, "report|0.7|1.5|smtp-in|link-disconnect|s1")
+	if report.GetType() != "report" || report.GetSessionId() != "s1" || len(report.GetParams()) != 0 {
+		t.Errorf("unexpected report %q", report.GetAtoms())
+	}
+}
+
+func TestEventWithoutPrinterDiscardsResponses(t *testing.T) {
+	ev := NewFilterEvent(nil, strings.Split(rcptLine, "|"))
+	// must not panic
+	ev.Responder().Proceed()
+	ev.Defer().Proceed()
+}
@@ -2,276 +2,185 @@ package opensmtpd
 
 import (
 	"bufio"
-	"fmt"
-	"os"
 	"strings"
+	"sync/atomic"
 )
 
 type FilterWrapper interface {
 	GetCapabilities() FilterDispatchMap
 	Register(EventResponder)
-	Dispatch([]string)
-	ProcessConfig(*bufio.Scanner)
+	Dispatch(FilterEvent)
+	ProcessConfig(*bufio.Scanner) error
+	GetConfig() *Config
+	GetSubsystems(typ, op string) []string
 	GetFilter() interface{}
+	OnFilter(event string, handler EventHandler, subsystems ...string) FilterWrapper
+	OnReport(event string, handler EventHandler, subsystems ...string) FilterWrapper
 }
 
 type FilterWrapperImpl struct {
 	Filter interface{}
+	config *Config
+
+	// handlers added through OnFilter and OnReport
+	handlers   FilterDispatchMap
+	subsystems map[string]map[string][]string
+
+	// built by Register, or by the first Dispatch if the wrapper wasn't
+	// registered itself, like the members of a Chain
+	table atomic.Pointer[dispatchTable]
 }
 
-func (fwi *FilterWrapperImpl) GetFilter() interface{} {
-	return fwi.Filter
+/*
+ * Handles the filter event with handler, in addition to the interfaces the
+ * filter implements. It replaces the filter's own handler for the event, if
+ * there is one. Without subsystems, the handler is registered for smtp-in.
+ * Handlers must be added before the filter is run.
+ */
+func (fwi *FilterWrapperImpl) OnFilter(event string, handler EventHandler, subsystems ...string) FilterWrapper {
+	fwi.addHandler("filter", event, handler, subsystems)
+	return fwi
 }
 
-func (fwi *FilterWrapperImpl) GetCapabilities() FilterDispatchMap {
-	capabilities := make(FilterDispatchMap)
+/*
+ * Like OnFilter, for report events.
+ */
+func (fwi *FilterWrapperImpl) OnReport(event string, handler EventHandler, subsystems ...string) FilterWrapper {
+	fwi.addHandler("report", event, handler, subsystems)
+	return fwi
+}
 
-	capabilities["report"] = make(map[string]EventHandler)
-	reportReceivers := capabilities["report"]
-	if _, ok := fwi.Filter.(LinkConnectReceiver); ok {
-		reportReceivers["link-connect"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(LinkConnectReceiver).LinkConnect(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(LinkDisconnectReceiver); ok {
-		reportReceivers["link-disconnect"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(LinkDisconnectReceiver).LinkDisconnect(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(LinkGreetingReceiver); ok {
-		reportReceivers["link-greeting"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(LinkGreetingReceiver).LinkGreeting(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(LinkIdentifyReceiver); ok {
-		reportReceivers["link-identify"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(LinkIdentifyReceiver).LinkIdentify(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(LinkTLSReceiver); ok {
-		reportReceivers["link-tls"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(LinkTLSReceiver).LinkTLS(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(LinkAuthReceiver); ok {
-		reportReceivers["link-auth"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(LinkAuthReceiver).LinkAuth(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(TxResetReceiver); ok {
-		reportReceivers["tx-reset"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TxResetReceiver).TxReset(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(TxBeginReceiver); ok {
-		reportReceivers["tx-begin"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TxBeginReceiver).TxBegin(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(TxMailReceiver); ok {
-		reportReceivers["tx-mail"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TxMailReceiver).TxMail(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(TxRcptReceiver); ok {
-		reportReceivers["tx-rcpt"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TxRcptReceiver).TxRcpt(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(TxEnvelopeReceiver); ok {
-		reportReceivers["tx-envelope"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TxEnvelopeReceiver).TxEnvelope(fw, ev)
-			}
+func (fwi *FilterWrapperImpl) addHandler(typ, event string, handler EventHandler, subsystems []string) {
+	if fwi.handlers == nil {
+		fwi.handlers = make(FilterDispatchMap)
+		fwi.subsystems = make(map[string]map[string][]string)
 	}
-	if _, ok := fwi.Filter.(TxDataReceiver); ok {
-		reportReceivers["tx-data"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TxDataReceiver).TxData(fw, ev)
-			}
+	if fwi.handlers[typ] == nil {
+		fwi.handlers[typ] = make(map[string]EventHandler)
+		fwi.subsystems[typ] = make(map[string][]string)
 	}
-	if _, ok := fwi.Filter.(TxCommitReceiver); ok {
-		reportReceivers["tx-commit"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TxCommitReceiver).TxCommit(fw, ev)
-			}
+	if len(subsystems) == 0 {
+		subsystems = []string{SubsystemSmtpIn}
 	}
-	if _, ok := fwi.Filter.(TxRollbackReceiver); ok {
-		reportReceivers["link-connect"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(LinkConnectReceiver).LinkConnect(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(ProtocolClientReceiver); ok {
-		reportReceivers["protocol-client"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(ProtocolClientReceiver).ProtocolClient(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(ProtocolServerReceiver); ok {
-		reportReceivers["protocol-server"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(ProtocolServerReceiver).ProtocolServer(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(TimeoutReceiver); ok {
-		reportReceivers["timeout"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(TimeoutReceiver).Timeout(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(FilterResponseReceiver); ok {
-		reportReceivers["filter-response"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(FilterResponseReceiver).FilterResponse(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(FilterReportReceiver); ok {
-		reportReceivers["filter-report"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(FilterReportReceiver).FilterReport(fw, ev)
-			}
-	}
-	capabilities["report"] = reportReceivers
+	fwi.handlers[typ][event] = handler
+	fwi.subsystems[typ][event] = subsystems
+	fwi.table.Store(nil)
+}
 
-	capabilities["filter"] = make(map[string]EventHandler)
-	filters := capabilities["filter"]
-	if _, ok := fwi.Filter.(ConnectFilter); ok {
-		filters["connect"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(ConnectFilter).Connect(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(HeloFilter); ok {
-		filters["helo"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(HeloFilter).Helo(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(EhloFilter); ok {
-		filters["ehlo"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(EhloFilter).Ehlo(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(StartTLSFilter); ok {
-		filters["starttls"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(StartTLSFilter).StartTLS(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(AuthFilter); ok {
-		filters["auth"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(AuthFilter).Auth(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(MailFromFilter); ok {
-		filters["mail-from"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(MailFromFilter).MailFrom(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(RcptToFilter); ok {
-		filters["rcpt-to"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(RcptToFilter).RcptTo(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(DataFilter); ok {
-		filters["data"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(DataFilter).Data(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(DatalineFilter); ok {
-		filters["data-line"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(DatalineFilter).Dataline(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(RsetFilter); ok {
-		filters["rset"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(RsetFilter).Rset(fw, ev)
-			}
-	}
-	if _, ok := fwi.Filter.(QuitFilter); ok {
-		filters["quit"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(QuitFilter).Quit(fw, ev)
-			}
+/*
+ * Returns the configuration received from OpenSMTPD, or nil before
+ * ProcessConfig has returned.
+ */
+func (fwi *FilterWrapperImpl) GetConfig() *Config {
+	return fwi.config
+}
+
+func (fwi *FilterWrapperImpl) GetFilter() interface{} {
+	return fwi.Filter
+}
+
+/*
+ * An event of eventTable, which is generated from events.json.
+ */
+type eventEntry struct {
+	typ         string
+	name        string
+	implemented func(filter interface{}) bool
+	handler     EventHandler
+	layout      eventLayout
+}
+
+func (fwi *FilterWrapperImpl) GetCapabilities() FilterDispatchMap {
+	capabilities := FilterDispatchMap{
+		"report": make(map[string]EventHandler),
+		"filter": make(map[string]EventHandler),
 	}
-	if _, ok := fwi.Filter.(NoopFilter); ok {
-		filters["noop"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(NoopFilter).Noop(fw, ev)
-			}
+	for _, entry := range eventTable {
+		if entry.implemented(fwi.Filter) {
+			capabilities[entry.typ][entry.name] = entry.handler
+		}
 	}
-	if _, ok := fwi.Filter.(HelpFilter); ok {
-		filters["help"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(HelpFilter).Help(fw, ev)
-			}
+
+	for typ, handlers := range fwi.handlers {
+		for op, handler := range handlers {
+			capabilities[typ][op] = handler
+		}
 	}
-	if _, ok := fwi.Filter.(WizFilter); ok {
-		filters["wiz"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(WizFilter).Wiz(fw, ev)
-			}
+	return capabilities
+}
+
+/*
+ * Returns the subsystems the handler for typ and op is registered for.
+ */
+func (fwi *FilterWrapperImpl) GetSubsystems(typ, op string) []string {
+	if subsystems, ok := fwi.subsystems[typ][op]; ok {
+		return subsystems
 	}
-	if _, ok := fwi.Filter.(CommitFilter); ok {
-		filters["commit"] =
-			func(fw FilterWrapper, ev FilterEvent) {
-				fw.GetFilter().(CommitFilter).Commit(fw, ev)
-			}
+	if sel, ok := fwi.Filter.(SubsystemSelector); ok {
+		return sel.Subsystems(typ, op)
 	}
-	capabilities["filter"] = filters
-	return capabilities
+	return []string{SubsystemSmtpIn}
 }
 
+/*
+ * Sends the register lines for the filter's handlers. The handlers are looked
+ * up once here instead of on every event.
+ */
 func (fwi *FilterWrapperImpl) Register(out EventResponder) {
-	capabilities := fwi.GetCapabilities()
-	for typ := range capabilities {
-		for op := range capabilities[typ] {
-			out.SafePrintln(fmt.Sprintf("register|%v|smtp-in|%v", typ, op))
-		}
-	}
-	out.SafePrintln("register|ready")
+	table := newDispatchTable(fwi)
+	fwi.table.Store(&table)
+	table.register(out)
 }
 
-func (fwi *FilterWrapperImpl) Dispatch(atoms []string) {
-	fcap := fwi.GetCapabilities()
-	if handler, ok := fcap[atoms[0]][atoms[4]]; ok {
-		event := NewFilterEvent(atoms)
-		//handler(fwi, verb: atoms[4], sh, sessionId: atoms[5], params: atoms[6:])
+func (fwi *FilterWrapperImpl) Dispatch(event FilterEvent) {
+	if handler, ok := fwi.dispatchTable().lookup(event.GetType(), event.GetVerb(), event.GetSubsystem()); ok {
 		handler(fwi, event)
 	}
 }
 
-func (fwi *FilterWrapperImpl) ProcessConfig(scanner *bufio.Scanner) {
+func (fwi *FilterWrapperImpl) dispatchTable() dispatchTable {
+	if table := fwi.table.Load(); table != nil {
+		return *table
+	}
+	table := newDispatchTable(fwi)
+	fwi.table.Store(&table)
+	return table
+}
+
+func (fwi *FilterWrapperImpl) ProcessConfig(scanner *bufio.Scanner) error {
+	config := NewConfig()
 	for {
 		if !scanner.Scan() {
-			os.Exit(0)
+			return scanError(scanner)
 		}
 		line := scanner.Text()
-		if cr, ok := fwi.Filter.(ConfigReceiver); ok {
-			cr.Config(strings.Split(line, "|"))
-		}
+		atoms := strings.Split(line, "|")
+		config.parseLine(atoms)
+		fwi.receiveConfigLine(atoms)
 
 		if line == "config|ready" {
-			return
+			fwi.setConfig(config)
+			return nil
 		}
 	}
 }
 
+func (fwi *FilterWrapperImpl) receiveConfigLine(atoms []string) {
+	if cr, ok := fwi.Filter.(ConfigReceiver); ok {
+		cr.Config(atoms)
+	}
+}
+
+func (fwi *FilterWrapperImpl) setConfig(config *Config) {
+	fwi.config = config
+}
+
+/*
+ * Implemented by the wrappers in this package, so a wrapper can hand the
+ * config lines it reads to wrappers it contains.
+ */
+type configForwarder interface {
+	receiveConfigLine(atoms []string)
+	setConfig(config *Config)
+}
+
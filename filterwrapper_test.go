@@ -0,0 +1,160 @@
+package opensmtpd
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDispatchDoesNotAllocate(t *testing.T) {
+	var calls int
+	handler := func(fw FilterWrapper, ev FilterEvent) {
+		calls++
+	}
+	fw := NewFilter(nil).OnReport("link-connect", handler).OnFilter("data-line", handler)
+	fw.Register(NewEventResponder(NewFilterEvent(discardPrinter{}, []string{})))
+
+	for _, line := range []string{
+		"report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25",
+		"filter|0.7|1.5|smtp-in|data-line|s1|t1|line",
+		// not registered
+		"report|0.7|1.5|smtp-in|link-disconnect|s1",
+	} {
+		ev := event(discardPrinter{}, line)
+		if allocs := testing.AllocsPerRun(100, func() { fw.Dispatch(ev) }); allocs != 0 {
+			t.Errorf("dispatching %s allocated %v times", line, allocs)
+		}
+	}
+	if calls == 0 {
+		t.Error("the handlers weren't called")
+	}
+}
+
+/*
+ * Returns the register lines fw sends, sorted as they're sent in map order,
+ * without the final register|ready.
+ */
+func registrations(t *testing.T, fw FilterWrapper) []string {
+	t.Helper()
+	out := &linePrinter{}
+	fw.Register(NewEventResponder(NewFilterEvent(out, []string{})))
+	lines := out.Lines()
+	if len(lines) == 0 || lines[len(lines)-1] != "register|ready" {
+		t.Fatalf("registration didn't end with register|ready: %q", lines)
+	}
+	lines = lines[:len(lines)-1]
+	sort.Strings(lines)
+	return lines
+}
+
+type subsystemFilter struct {
+	calls []string
+}
+
+func (f *subsystemFilter) GetName() string {
+	return "subsystems"
+}
+
+func (f *subsystemFilter) Subsystems(eventType, event string) []string {
+	if eventType == "report" {
+		return []string{SubsystemSmtpIn, SubsystemSmtpOut}
+	}
+	return []string{SubsystemSmtpIn}
+}
+
+func (f *subsystemFilter) LinkConnect(fw FilterWrapper, ev FilterEvent) {
+	f.calls = append(f.calls, ev.GetSubsystem()+"|"+ev.GetVerb())
+}
+
+func (f *subsystemFilter) Helo(fw FilterWrapper, ev FilterEvent) {
+	f.calls = append(f.calls, ev.GetSubsystem()+"|"+ev.GetVerb())
+	ev.Responder().Proceed()
+}
+
+func TestRegisterSubsystems(t *testing.T) {
+	f := &subsystemFilter{}
+	fw := NewFilter(f).OnReport("tx-mail", func(fw FilterWrapper, ev FilterEvent) {
+		f.calls = append(f.calls, ev.GetSubsystem()+"|"+ev.GetVerb())
+	}, SubsystemSmtpOut).OnFilter("mail-from", func(fw FilterWrapper, ev FilterEvent) {
+		f.calls = append(f.calls, ev.GetSubsystem()+"|"+ev.GetVerb())
+		ev.Responder().Proceed()
+	}, SubsystemSmtpIn, SubsystemSmtpOut)
+
+	want := []string{
+		"register|filter|smtp-in|helo",
+		"register|filter|smtp-in|mail-from",
+		"register|filter|smtp-out|mail-from",
+		"register|report|smtp-in|link-connect",
+		"register|report|smtp-out|link-connect",
+		"register|report|smtp-out|tx-mail",
+	}
+	if got := registrations(t, fw); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, line := range []string{
+		"report|0.7|1.5|smtp-out|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25",
+		"report|0.7|1.5|smtp-in|tx-mail|s1|m1|ok|sender@example.org",
+		"report|0.7|1.5|smtp-out|tx-mail|s1|m1|ok|sender@example.org",
+		"filter|0.7|1.5|smtp-out|helo|s1|t1|example.org",
+		"filter|0.7|1.5|smtp-in|helo|s1|t2|example.org",
+		"filter|0.7|1.5|smtp-out|mail-from|s1|t3|sender@example.org",
+	} {
+		fw.Dispatch(event(discardPrinter{}, line))
+	}
+	if want := []string{"smtp-out|link-connect", "smtp-out|tx-mail", "smtp-in|helo", "smtp-out|mail-from"}; strings.Join(f.calls, ",") != strings.Join(want, ",") {
+		t.Errorf("handled %q, want %q", f.calls, want)
+	}
+}
+
+func TestOnFilterReplacesHandlers(t *testing.T) {
+	f := &subsystemFilter{}
+	var calls []string
+	fw := NewFilter(f).OnFilter("helo", func(fw FilterWrapper, ev FilterEvent) {
+		calls = append(calls, "first")
+	}).OnFilter("helo", func(fw FilterWrapper, ev FilterEvent) {
+		calls = append(calls, "second")
+	}).OnReport("link-connect", func(fw FilterWrapper, ev FilterEvent) {
+		calls = append(calls, "link-connect")
+	})
+
+	// the filter's own Helo and the first handler are replaced
+	fw.Dispatch(event(discardPrinter{}, "filter|0.7|1.5|smtp-in|helo|s1|t1|example.org"))
+	if len(f.calls) != 0 || strings.Join(calls, ",") != "second" {
+		t.Errorf("got filter calls %q and handler calls %q", f.calls, calls)
+	}
+	// without subsystems, a handler is registered for smtp-in only, even
+	// if the filter selects others
+	want := []string{
+		"register|filter|smtp-in|helo",
+		"register|report|smtp-in|link-connect",
+	}
+	if got := registrations(t, fw); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOnReportAddsEventsUnknownToTheLibrary(t *testing.T) {
+	var params []string
+	fw := NewFilter(nil).OnReport("future-event", func(fw FilterWrapper, ev FilterEvent) {
+		params = ev.GetParams()
+	})
+	if got := registrations(t, fw); len(got) != 1 || got[0] != "register|report|smtp-in|future-event" {
+		t.Errorf("unexpected registrations %q", got)
+	}
+
+	fw.Dispatch(event(discardPrinter{}, "report|0.8|1.5|smtp-in|future-event|s1|a|b"))
+	if strings.Join(params, ",") != "a,b" {
+		t.Errorf("unexpected params %q", params)
+	}
+
+	// a handler added after the table was built is still used
+	var called bool
+	fw.OnReport("other-event", func(fw FilterWrapper, ev FilterEvent) {
+		called = true
+	})
+	fw.Dispatch(event(discardPrinter{}, "report|0.8|1.5|smtp-in|other-event|s1"))
+	if !called {
+		t.Error("the handler added later wasn't called")
+	}
+}
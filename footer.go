@@ -0,0 +1,202 @@
+package opensmtpd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+/*
+ * Adds text to the text/plain and html to the text/html parts of the
+ * message body, leaving attachments alone. An empty footer isn't added.
+ * The parts are converted to UTF-8 and encoded again with their transfer
+ * encoding, or quoted-printable if the footer doesn't fit into it. Returns
+ * ErrSignedMessage for signed or encrypted messages and ErrNoTextPart if
+ * there is no part to add the footers to; the message isn't changed then.
+ */
+func (p *MIMEPart) AddFooter(text, html string) error {
+	parts, err := p.footerParts(nil)
+	if err != nil {
+		return err
+	}
+
+	type change struct {
+		part *MIMEPart
+		body string
+	}
+	var changes []change
+	for _, part := range parts {
+		footer := text
+		if part.MediaType == "text/html" {
+			footer = html
+		}
+		if footer == "" {
+			continue
+		}
+		body, err := part.Text()
+		if err != nil {
+			return err
+		}
+		if part.MediaType == "text/html" {
+			body = insertHTMLFooter(body, footer)
+		} else {
+			body = appendTextFooter(body, footer)
+		}
+		changes = append(changes, change{part, body})
+	}
+	if len(changes) == 0 {
+		return ErrNoTextPart
+	}
+
+	for _, c := range changes {
+		c.part.setText(c.body)
+	}
+	return nil
+}
+
+/*
+ * Returns the parts of the body the footers are added to: the text parts
+ * of the message, of every alternative and of the first part of other
+ * multipart bodies.
+ */
+func (p *MIMEPart) footerParts(parts []*MIMEPart) ([]*MIMEPart, error) {
+	switch {
+	case isSigned(p.MediaType):
+		return nil, ErrSignedMessage
+	case p.Disposition() == "attachment":
+		return parts, nil
+	case p.MediaType == "text/plain", p.MediaType == "text/html":
+		return append(parts, p), nil
+	case p.MediaType == "multipart/alternative":
+		var err error
+		for _, part := range p.Parts {
+			if parts, err = part.footerParts(parts); err != nil {
+				return nil, err
+			}
+		}
+		return parts, nil
+	case p.IsMultipart() && len(p.Parts) > 0:
+		// the body of multipart/mixed and the root of multipart/related
+		return p.Parts[0].footerParts(parts)
+	}
+	return parts, nil
+}
+
+func isSigned(mediaType string) bool {
+	switch mediaType {
+	case "multipart/signed", "multipart/encrypted", "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	}
+	return false
+}
+
+func appendTextFooter(body, footer string) string {
+	if body != "" && !strings.HasSuffix(body, "\n") {
+		body += "\r\n"
+	}
+	return body + footer
+}
+
+/*
+ * Inserts footer before the closing body tag, or the closing html tag, or
+ * at the end.
+ */
+func insertHTMLFooter(body, footer string) string {
+	lower := strings.ToLower(body)
+	for _, tag := range []string{"</body>", "</html>"} {
+		if i := strings.LastIndex(lower, tag); i >= 0 {
+			return body[:i] + footer + body[i:]
+		}
+	}
+	return body + footer
+}
+
+/*
+ * Replaces the body with text, which is encoded as UTF-8 with the part's
+ * transfer encoding, or quoted-printable if that one can't carry it.
+ */
+func (p *MIMEPart) setText(text string) {
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+
+	cte := p.TransferEncoding()
+	switch cte {
+	case "base64", "quoted-printable":
+	case "8bit", "binary":
+		if !fitsLines(text) {
+			cte = "quoted-printable"
+		}
+	default:
+		if !isASCII(text) || !fitsLines(text) {
+			cte = "quoted-printable"
+		}
+	}
+
+	var encoded string
+	switch cte {
+	case "base64":
+		encoded = encodeBase64Lines(text)
+	case "quoted-printable":
+		var b bytes.Buffer
+		w := quotedprintable.NewWriter(&b)
+		w.Write([]byte(text))
+		w.Close()
+		encoded = b.String()
+	default:
+		encoded = text
+	}
+
+	if p.parent == nil {
+		// the line break after the last line is added when the message is
+		// written
+		encoded = strings.TrimSuffix(encoded, "\r\n")
+	}
+	p.body = strings.Split(encoded, "\r\n")
+
+	changed := false
+	if !strings.EqualFold(p.Params["charset"], "utf-8") {
+		p.Params["charset"] = "utf-8"
+		if contentType := mime.FormatMediaType(p.MediaType, p.Params); contentType != "" {
+			_ = p.Header.Set("Content-Type", contentType)
+			changed = true
+		}
+	}
+	if cte != p.TransferEncoding() {
+		_ = p.Header.Set("Content-Transfer-Encoding", cte)
+		changed = true
+	}
+	// the MIME fields of a plain RFC 5322 message only count with it
+	if changed && p.parent == nil && !p.Header.Has("MIME-Version") {
+		_ = p.Header.Add("MIME-Version", "1.0")
+	}
+	p.bare = false
+	if len(p.Header.fields) > 0 {
+		p.separator = true
+	}
+}
+
+/*
+ * Reports whether every line of text is within the 998 characters SMTP
+ * allows.
+ */
+func fitsLines(text string) bool {
+	for _, line := range strings.Split(text, "\r\n") {
+		if len(line) > 998 {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeBase64Lines(text string) string {
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	return b.String()
+}
@@ -0,0 +1,129 @@
+package opensmtpd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAddFooter(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "plain message gets MIME headers",
+			in:   []string{"Subject: hi", "", "hello"},
+			want: []string{
+				"Subject: hi",
+				"Content-Type: text/plain; charset=utf-8",
+				"MIME-Version: 1.0",
+				"",
+				"hello",
+				"-- ",
+				"footer",
+			},
+		},
+		{
+			name: "quoted-printable latin1",
+			in: []string{
+				"MIME-Version: 1.0",
+				"Content-Type: text/plain; charset=iso-8859-1",
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"Gr=FC=DFe",
+			},
+			want: []string{
+				"MIME-Version: 1.0",
+				"Content-Type: text/plain; charset=utf-8",
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"Gr=C3=BC=C3=9Fe",
+				"--=20",
+				"footer",
+			},
+		},
+		{
+			name: "alternative",
+			in: []string{
+				"MIME-Version: 1.0",
+				`Content-Type: multipart/alternative; boundary="b"`,
+				"",
+				"--b",
+				"Content-Type: text/plain; charset=utf-8",
+				"",
+				"hello",
+				"--b",
+				"Content-Type: text/html; charset=utf-8",
+				"",
+				"<html><body>hello</body></html>",
+				"--b--",
+			},
+			want: []string{
+				"MIME-Version: 1.0",
+				`Content-Type: multipart/alternative; boundary="b"`,
+				"",
+				"--b",
+				"Content-Type: text/plain; charset=utf-8",
+				"",
+				"hello",
+				"-- ",
+				"footer",
+				"--b",
+				"Content-Type: text/html; charset=utf-8",
+				"",
+				"<html><body>hello<p>footer</p></body></html>",
+				"--b--",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseMessage(tt.in)
+			if err := msg.AddFooter("-- \nfooter", "<p>footer</p>"); err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.appendLines(nil); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddFooterLeavesMessageAlone(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		err  error
+	}{
+		{
+			name: "signed",
+			in: []string{
+				`Content-Type: multipart/signed; boundary="b"; protocol="application/pgp-signature"`,
+				"",
+				"--b",
+				"",
+				"hello",
+				"--b--",
+			},
+			err: ErrSignedMessage,
+		},
+		{
+			name: "no text part",
+			in:   []string{"Content-Type: image/png", "Content-Transfer-Encoding: base64", "", "iVBORw0KGgo="},
+			err:  ErrNoTextPart,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseMessage(tt.in)
+			if err := msg.AddFooter("footer", "footer"); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if got := msg.appendLines(nil); strings.Join(got, "\n") != strings.Join(tt.in, "\n") {
+				t.Errorf("the message changed to %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package opensmtpd
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// the length RFC 5322 recommends for header lines
+const maxHeaderLineLength = 78
+
+/*
+ * A header field as it appeared in the message.
+ */
+type HeaderField struct {
+	// the name as written, like "Content-Type"
+	Name string
+	// the lines of the field as received; the first one starts with the
+	// name, the others are folded continuations
+	Lines []string
+}
+
+/*
+ * Returns the unfolded value, without the RFC 2047 encoded-words decoded.
+ */
+func (f HeaderField) Value() string {
+	_, value, _ := strings.Cut(strings.Join(f.Lines, ""), ":")
+	return strings.TrimSpace(value)
+}
+
+/*
+ * The header fields of a message or MIME part, in order. Names are
+ * matched case-insensitively.
+ */
+type Header struct {
+	fields []HeaderField
+}
+
+func (h *Header) Fields() []HeaderField {
+	return append([]HeaderField(nil), h.fields...)
+}
+
+/*
+ * Returns the value of the first field called name, or "".
+ */
+func (h *Header) Get(name string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value()
+		}
+	}
+	return ""
+}
+
+/*
+ * Returns the values of all fields called name.
+ */
+func (h *Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value())
+		}
+	}
+	return values
+}
+
+func (h *Header) Has(name string) bool {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Returns the value of the first field called name, with RFC 2047
+ * encoded-words decoded, or "".
+ */
+func (h *Header) Decoded(name string) string {
+	value := h.Get(name)
+	decoder := mime.WordDecoder{CharsetReader: charsetReader}
+	if decoded, err := decoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+/*
+ * Adds a field after the other fields. value is encoded and folded: line
+ * breaks become spaces, words with characters outside of US-ASCII are
+ * RFC 2047 encoded and long lines are folded at whitespace. Returns an
+ * error, and leaves the header alone, if name isn't a valid field name:
+ * printable US-ASCII characters other than ':'.
+ */
+func (h *Header) Add(name, value string) error {
+	f, err := newHeaderField(name, value)
+	if err != nil {
+		return err
+	}
+	h.fields = append(h.fields, f)
+	return nil
+}
+
+/*
+ * Adds a field before the other fields, like trace fields are added. See
+ * Add for how value is encoded.
+ */
+func (h *Header) Prepend(name, value string) error {
+	f, err := newHeaderField(name, value)
+	if err != nil {
+		return err
+	}
+	h.fields = append([]HeaderField{f}, h.fields...)
+	return nil
+}
+
+/*
+ * Replaces the first field called name and deletes the others, or adds
+ * the field if there is none. See Add for how value is encoded.
+ */
+func (h *Header) Set(name, value string) error {
+	field, err := newHeaderField(name, value)
+	if err != nil {
+		return err
+	}
+	fields := h.fields[:0]
+	set := false
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		} else if !set {
+			fields = append(fields, field)
+			set = true
+		}
+	}
+	h.fields = fields
+	if !set {
+		h.fields = append(h.fields, field)
+	}
+	return nil
+}
+
+/*
+ * Deletes all fields called name.
+ */
+func (h *Header) Del(name string) {
+	fields := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.Name, name) {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+func newHeaderField(name, value string) (HeaderField, error) {
+	if !validHeaderName(name) {
+		return HeaderField{}, fmt.Errorf("opensmtpd: invalid header field name %q", name)
+	}
+	return HeaderField{
+		Name:  name,
+		Lines: foldHeader(name, encodeHeaderValue(value)),
+	}, nil
+}
+
+/*
+ * Field names consist of printable US-ASCII characters other than ':'
+ * (RFC 5322 section 2.2).
+ */
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Trims value, replaces line breaks with spaces and encodes the runs of words that
+ * contain characters outside of US-ASCII as RFC 2047 encoded-words.
+ */
+func encodeHeaderValue(value string) string {
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+	value = strings.TrimSpace(value)
+	words := strings.Split(value, " ")
+	out := make([]string, 0, len(words))
+	for i := 0; i < len(words); {
+		if isASCII(words[i]) {
+			out = append(out, words[i])
+			i++
+			continue
+		}
+		// encode the spaces between the words too, they would be dropped
+		// between two encoded-words
+		j := i + 1
+		for j < len(words) && !isASCII(words[j]) {
+			j++
+		}
+		out = append(out, mime.QEncoding.Encode("utf-8", strings.Join(words[i:j], " ")))
+		i = j
+	}
+	return strings.Join(out, " ")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Returns the lines of the field, folded before whitespace so that they
+ * aren't longer than 78 characters where possible.
+ */
+func foldHeader(name, value string) []string {
+	line := name + ": " + value
+	var lines []string
+	// don't break between the name and the value
+	min := len(name) + 2
+	for len(line) > maxHeaderLineLength {
+		i := strings.LastIndexAny(line[:maxHeaderLineLength+1], " \t")
+		if i < min {
+			// a word longer than a line, break after it
+			j := strings.IndexAny(line[maxHeaderLineLength:], " \t")
+			if j < 0 {
+				break
+			}
+			i = maxHeaderLineLength + j
+		}
+		lines = append(lines, line[:i])
+		// the continuation starts with the whitespace
+		line = line[i:]
+		min = 1
+	}
+	return append(lines, line)
+}
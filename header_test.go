@@ -0,0 +1,80 @@
+package opensmtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHeaderEditing(t *testing.T) {
+	msg := parseMessage([]string{
+		"Received: from a",
+		"Subject: hello",
+		"X-Tag: 1",
+		"x-tag: 2",
+		"",
+		"body",
+	})
+	if err := msg.Header.Prepend("Received", "from b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Header.Set("X-Tag", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Header.Add("X-Spam-Score", "1.5"); err != nil {
+		t.Fatal(err)
+	}
+	msg.Header.Del("subject")
+
+	want := []string{
+		"Received: from b",
+		"Received: from a",
+		"X-Tag: 3",
+		"X-Spam-Score: 1.5",
+		"",
+		"body",
+	}
+	if got := msg.appendLines(nil); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHeaderRejectsInvalidNames(t *testing.T) {
+	for _, name := range []string{"", "X-A: 1\nBcc", "X A", "X:A", "X-\x7f", "X-ä"} {
+		h := &Header{}
+		if h.Add(name, "v") == nil || h.Prepend(name, "v") == nil || h.Set(name, "v") == nil {
+			t.Errorf("%q was accepted", name)
+		}
+		if len(h.Fields()) != 0 {
+			t.Errorf("%q added %q", name, h.Fields())
+		}
+	}
+}
+
+func TestHeaderEncodesValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		lines []string
+	}{
+		{"line breaks", "a\r\nBcc: b\nc", []string{"Subject: a Bcc: b c"}},
+		{"non-ASCII", "Grüße aus Köln", []string{"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?= aus =?utf-8?q?K=C3=B6ln?="}},
+		{"folded", strings.Repeat("word ", 20), []string{
+			"Subject: word word word word word word word word word word word word word word",
+			" word word word word word word",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Header{}
+			if err := h.Add("Subject", tt.value); err != nil {
+				t.Fatal(err)
+			}
+			if got := h.Fields()[0].Lines; strings.Join(got, "\n") != strings.Join(tt.lines, "\n") {
+				t.Errorf("got %q, want %q", got, tt.lines)
+			}
+			if got := h.Decoded("Subject"); got != strings.Join(strings.Fields(strings.ReplaceAll(tt.value, "\n", " ")), " ") {
+				t.Errorf("decoded to %q", got)
+			}
+		})
+	}
+}
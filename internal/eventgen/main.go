@@ -0,0 +1,332 @@
+/*
+ * Command eventgen generates the event structs, receiver interfaces and
+ * dispatch table of package opensmtpd from events.json. It is run by
+ * "go generate" in the package directory.
+ *
+ * events.json lists the "report" and "filter" events smtpd sends. For each
+ * event it holds:
+ *
+ *   name     the event name, which is also the phase for filter events
+ *   go       the Go name, used for the struct ("...Request" for filter
+ *            events), the receiver interface ("...Receiver" or "...Filter")
+ *            and its method
+ *   params   the parameters after the session id (and token), in protocol
+ *            order, each with the protocol name, the Go field and a type:
+ *              string         a single atom
+ *              text           may contain "|", only allowed as the last
+ *                             parameter (but anywhere in legacy orders)
+ *              optional-text  like text, but may be missing
+ *              int            a decimal integer
+ *              address        an address as printed by smtpd, as
+ *                             netip.AddrPort
+ *   legacy   optional: the parameter order of protocol versions before
+ *            "before", as a list of parameter names
+ *   custom   optional: the struct and its parse function are hand-written
+ *   rewrite  optional: filter events that can be answered with a rewrite
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const header = "// Code generated by eventgen from events.json. DO NOT EDIT.\n\npackage opensmtpd\n"
+
+type param struct {
+	Name  string `json:"name"`
+	Field string `json:"field"`
+	Type  string `json:"type"`
+}
+
+type legacy struct {
+	Before string   `json:"before"`
+	Params []string `json:"params"`
+}
+
+type event struct {
+	Name    string  `json:"name"`
+	Go      string  `json:"go"`
+	Params  []param `json:"params"`
+	Legacy  *legacy `json:"legacy"`
+	Custom  bool    `json:"custom"`
+	Rewrite bool    `json:"rewrite"`
+
+	typ string
+}
+
+type schema struct {
+	Report []*event `json:"report"`
+	Filter []*event `json:"filter"`
+}
+
+func (e *event) structName() string {
+	if e.typ == "filter" {
+		return e.Go + "Request"
+	}
+	return e.Go
+}
+
+func (e *event) interfaceName() string {
+	if e.typ == "filter" {
+		return e.Go + "Filter"
+	}
+	return e.Go + "Receiver"
+}
+
+/*
+ * Returns the eventLayout literal the line parser uses for the event.
+ */
+func (e *event) layout() string {
+	var fields []string
+	if n := len(e.Params); n > 0 {
+		fields = append(fields, fmt.Sprintf("params: %d", n))
+		if last := e.Params[n-1].Type; last == "text" || last == "optional-text" {
+			fields = append(fields, "text: true")
+		}
+		if e.Params[n-1].Type == "optional-text" {
+			fields = append(fields, "optional: 1")
+		}
+	}
+	if e.Legacy != nil {
+		fields = append(fields, fmt.Sprintf("legacy: %q", e.Legacy.Before),
+			fmt.Sprintf("legacyParams: %d", len(e.Legacy.Params)))
+	}
+	return "eventLayout{" + strings.Join(fields, ", ") + "}"
+}
+
+var goTypes = map[string]string{
+	"string":        "string",
+	"text":          "string",
+	"optional-text": "string",
+	"int":           "int",
+	"address":       "netip.AddrPort",
+}
+
+func main() {
+	schemaPath := flag.String("schema", "events.json", "path of the event schema")
+	outDir := flag.String("out", ".", "directory to write the generated files to")
+	flag.Parse()
+
+	files, err := generate(*schemaPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(*outDir, name), src, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+/*
+ * Returns the formatted files generated from the schema at schemaPath, by
+ * name.
+ */
+func generate(schemaPath string) (map[string][]byte, error) {
+	data, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	var s schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", schemaPath, err)
+	}
+	for _, e := range s.Report {
+		e.typ = "report"
+	}
+	for _, e := range s.Filter {
+		e.typ = "filter"
+	}
+	events := append(append([]*event{}, s.Report...), s.Filter...)
+	if err := check(events); err != nil {
+		return nil, fmt.Errorf("%s: %v", schemaPath, err)
+	}
+
+	files := map[string]string{
+		"events.go":                genEvents(events),
+		"report_api_interfaces.go": genInterfaces(s.Report),
+		"filter_api_interfaces.go": genInterfaces(s.Filter),
+		"dispatch.go":              genDispatch(events),
+	}
+	formatted := make(map[string][]byte, len(files))
+	for name, src := range files {
+		f, err := format.Source([]byte(src))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v\n%s", name, err, src)
+		}
+		formatted[name] = f
+	}
+	return formatted, nil
+}
+
+func check(events []*event) error {
+	for _, e := range events {
+		if e.Name == "" || e.Go == "" {
+			return fmt.Errorf("event without name or go name")
+		}
+		fields := make(map[string]bool)
+		for i, p := range e.Params {
+			if (p.Type == "text" || p.Type == "optional-text") && i != len(e.Params)-1 {
+				// the line parser leaves "|" alone only in the last parameter
+				return fmt.Errorf("%s: %s of type %s must be the last parameter", e.Name, p.Name, p.Type)
+			}
+			if _, ok := goTypes[p.Type]; !ok {
+				return fmt.Errorf("%s: unknown type %q of %s", e.Name, p.Type, p.Name)
+			}
+			if p.Field == "" && !e.Custom {
+				return fmt.Errorf("%s: %s has no field", e.Name, p.Name)
+			}
+			fields[p.Name] = true
+		}
+		if e.Legacy != nil {
+			for _, name := range e.Legacy.Params {
+				if !fields[name] {
+					return fmt.Errorf("%s: unknown legacy parameter %s", e.Name, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func genEvents(events []*event) string {
+	var b bytes.Buffer
+	b.WriteString(header)
+	b.WriteString(`
+import (
+	"net/netip"
+)
+
+/*
+ * Parsed parameters of every report and filter event. Each accessor returns
+ * an error if the event is of a different kind or its parameters can't be
+ * parsed.
+ */
+type EventAccessors interface {
+`)
+	for _, e := range events {
+		fmt.Fprintf(&b, "\t%s() (%s, error)\n", e.structName(), e.structName())
+	}
+	b.WriteString("}\n")
+
+	for _, e := range events {
+		if e.Custom {
+			continue
+		}
+		kind := "report"
+		if e.typ == "filter" {
+			kind = "filter request"
+		}
+		fmt.Fprintf(&b, "\n// Parameters of the %s %s.\n", e.Name, kind)
+		if len(e.Params) == 0 {
+			fmt.Fprintf(&b, "type %s struct{}\n", e.structName())
+		} else {
+			fmt.Fprintf(&b, "type %s struct {\n", e.structName())
+			for _, p := range e.Params {
+				fmt.Fprintf(&b, "\t%s %s\n", p.Field, goTypes[p.Type])
+			}
+			b.WriteString("}\n")
+		}
+
+		fmt.Fprintf(&b, "\nfunc parse%s(ev FilterEvent) (%s, error) {\n", e.structName(), e.structName())
+		fmt.Fprintf(&b, "\tvar e %s\n", e.structName())
+		fmt.Fprintf(&b, "\tp := newParamReader(ev, %q, %q)\n", e.typ, e.Name)
+		if e.Legacy != nil {
+			byName := make(map[string]param)
+			for _, p := range e.Params {
+				byName[p.Name] = p
+			}
+			var params []param
+			for _, name := range e.Legacy.Params {
+				params = append(params, byName[name])
+			}
+			fmt.Fprintf(&b, "\tif p.before(%q) {\n", e.Legacy.Before)
+			writeReads(&b, params, "\t\t")
+			b.WriteString("\t} else {\n")
+			writeReads(&b, e.Params, "\t\t")
+			b.WriteString("\t}\n")
+		} else {
+			writeReads(&b, e.Params, "\t")
+		}
+		b.WriteString("\treturn e, p.err\n}\n")
+	}
+
+	for _, e := range events {
+		fmt.Fprintf(&b, "\nfunc (freq *FilterEventImpl) %s() (%s, error) {\n\treturn parse%s(freq)\n}\n",
+			e.structName(), e.structName(), e.structName())
+	}
+	return b.String()
+}
+
+func writeReads(b *bytes.Buffer, params []param, indent string) {
+	for i, p := range params {
+		var read string
+		switch p.Type {
+		case "string":
+			read = fmt.Sprintf("p.str(%q)", p.Name)
+		case "text":
+			read = fmt.Sprintf("p.rest(%q, %d)", p.Name, len(params)-i-1)
+		case "optional-text":
+			read = fmt.Sprintf("p.optRest(%q)", p.Name)
+		case "int":
+			read = fmt.Sprintf("p.int(%q)", p.Name)
+		case "address":
+			read = fmt.Sprintf("p.addr(%q)", p.Name)
+		}
+		fmt.Fprintf(b, "%se.%s = %s\n", indent, p.Field, read)
+	}
+}
+
+func genInterfaces(events []*event) string {
+	var b bytes.Buffer
+	b.WriteString(header)
+	for _, e := range events {
+		fmt.Fprintf(&b, "\ntype %s interface {\n\t%s(FilterWrapper, FilterEvent)\n}\n", e.interfaceName(), e.Go)
+	}
+	return b.String()
+}
+
+func genDispatch(events []*event) string {
+	var b bytes.Buffer
+	b.WriteString(header)
+	b.WriteString(`
+/*
+ * Every event a filter can receive by implementing the matching interface.
+ */
+var eventTable = []eventEntry{
+`)
+	for _, e := range events {
+		fmt.Fprintf(&b, `	{
+		typ:  %q,
+		name: %q,
+		implemented: func(filter interface{}) bool {
+			_, ok := filter.(%s)
+			return ok
+		},
+		handler: func(fw FilterWrapper, ev FilterEvent) {
+			fw.GetFilter().(%s).%s(fw, ev)
+		},
+		layout: %s,
+	},
+`, e.typ, e.Name, e.interfaceName(), e.interfaceName(), e.Go, e.layout())
+	}
+	b.WriteString("}\n")
+
+	var rewrite []string
+	for _, e := range events {
+		if e.Rewrite {
+			rewrite = append(rewrite, fmt.Sprintf("\t%q: true,\n", e.Name))
+		}
+	}
+	fmt.Fprintf(&b, "\n// Filter phases that can be answered with a rewrite.\nvar rewritablePhases = map[string]bool{\n%s}\n",
+		strings.Join(rewrite, ""))
+	return b.String()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * Fails if the committed files differ from what events.json generates, for
+ * example after the schema was changed without running go generate.
+ */
+func TestGeneratedFilesAreUpToDate(t *testing.T) {
+	root := filepath.Join("..", "..")
+	files, err := generate(filepath.Join(root, "events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is out of date, run go generate", name)
+		}
+	}
+}
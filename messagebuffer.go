@@ -0,0 +1,274 @@
+package opensmtpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * Limits for the messages SessionTrackingMixin collects. A zero value means
+ * no limit. Several filters may share the same limits, and then share
+ * MaxTotalMemory. Don't copy limits that are in use.
+ */
+type MessageLimits struct {
+	// bytes of a message kept in memory before it is spilled to a
+	// temporary file
+	MaxMemory int64
+	// bytes of all messages kept in memory; messages that don't fit are
+	// spilled
+	MaxTotalMemory int64
+	// messages larger than this are discarded and rejected at commit
+	MaxSize int64
+	// directory for the temporary files, os.TempDir() if empty
+	TempDir string
+
+	used atomic.Int64
+}
+
+/*
+ * Takes n bytes of MaxTotalMemory. Returns false if they aren't available.
+ */
+func (ml *MessageLimits) reserve(n int64) bool {
+	if ml.MaxTotalMemory <= 0 {
+		return true
+	}
+	if ml.used.Add(n) > ml.MaxTotalMemory {
+		ml.used.Add(-n)
+		return false
+	}
+	return true
+}
+
+func (ml *MessageLimits) release(n int64) {
+	if ml.MaxTotalMemory > 0 {
+		ml.used.Add(-n)
+	}
+}
+
+/*
+ * The dot-unescaped lines of a message. They are kept in memory until they
+ * exceed the MessageLimits and written to a temporary file after that;
+ * Each reads them the same way in both cases. Safe for concurrent use.
+ */
+type MessageBuffer struct {
+	mu     sync.Mutex
+	limits *MessageLimits
+
+	lines []string
+	// bytes of lines taken from the limits
+	memory int64
+	// bytes of the message, counting line endings as CRLF
+	size int64
+
+	file *os.File
+	w    *bufio.Writer
+
+	err    error
+	closed bool
+}
+
+func newMessageBuffer(limits *MessageLimits) *MessageBuffer {
+	if limits == nil {
+		limits = &MessageLimits{}
+	}
+	return &MessageBuffer{
+		limits: limits,
+	}
+}
+
+/*
+ * Adds a line. Once the message is larger than MaxSize, it is discarded and
+ * Append returns a *MessageTooLargeError.
+ */
+func (mb *MessageBuffer) Append(line string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed {
+		return errors.New("opensmtpd: message buffer is closed")
+	}
+	if mb.err != nil {
+		return mb.err
+	}
+
+	n := int64(len(line))
+	mb.size += n + 2
+	if max := mb.limits.MaxSize; max > 0 && mb.size > max {
+		mb.discard()
+		mb.err = &MessageTooLargeError{Max: max}
+		return mb.err
+	}
+
+	if mb.file == nil {
+		fits := mb.limits.MaxMemory <= 0 || mb.memory+n <= mb.limits.MaxMemory
+		if fits && mb.limits.reserve(n) {
+			mb.lines = append(mb.lines, line)
+			mb.memory += n
+			return nil
+		}
+		if err := mb.spill(); err != nil {
+			mb.err = err
+			return err
+		}
+	}
+
+	mb.w.WriteString(line)
+	if err := mb.w.WriteByte('\n'); err != nil {
+		mb.err = fmt.Errorf("opensmtpd: spilling message: %w", err)
+		return mb.err
+	}
+	return nil
+}
+
+/*
+ * Moves the lines in memory to a temporary file.
+ */
+func (mb *MessageBuffer) spill() error {
+	f, err := os.CreateTemp(mb.limits.TempDir, "opensmtpd-message-")
+	if err != nil {
+		return fmt.Errorf("opensmtpd: spilling message: %w", err)
+	}
+	mb.file = f
+	mb.w = bufio.NewWriter(f)
+	for _, line := range mb.lines {
+		mb.w.WriteString(line)
+		mb.w.WriteByte('\n')
+	}
+	mb.lines = nil
+	mb.limits.release(mb.memory)
+	mb.memory = 0
+	return nil
+}
+
+/*
+ * Frees the lines and removes the temporary file.
+ */
+func (mb *MessageBuffer) discard() {
+	mb.lines = nil
+	mb.limits.release(mb.memory)
+	mb.memory = 0
+	if mb.file != nil {
+		mb.file.Close()
+		os.Remove(mb.file.Name())
+		mb.file = nil
+		mb.w = nil
+	}
+}
+
+/*
+ * Returns the lines while the message is kept in memory, nil once it was
+ * spilled to a file.
+ */
+func (mb *MessageBuffer) Lines() []string {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.lines
+}
+
+/*
+ * Reports whether the message was moved to a temporary file.
+ */
+func (mb *MessageBuffer) Spilled() bool {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.file != nil
+}
+
+/*
+ * Returns the size of the message in bytes, counting line endings as CRLF.
+ */
+func (mb *MessageBuffer) Size() int64 {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.size
+}
+
+/*
+ * Returns the first error that occurred while the message was written to or
+ * read from the buffer.
+ */
+func (mb *MessageBuffer) Err() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.err
+}
+
+/*
+ * Calls fn for every line, in order, until fn returns an error. fn must not
+ * call methods of the buffer.
+ */
+func (mb *MessageBuffer) Each(fn func(line string) error) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed {
+		return errors.New("opensmtpd: message buffer is closed")
+	}
+	if mb.file == nil {
+		for _, line := range mb.lines {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if mb.err != nil {
+		// the file is incomplete
+		return mb.err
+	}
+	if err := mb.readFile(fn); err != nil {
+		if mb.err == nil {
+			mb.err = err
+		}
+		return err
+	}
+	return nil
+}
+
+func (mb *MessageBuffer) readFile(fn func(line string) error) error {
+	if err := mb.w.Flush(); err != nil {
+		return fmt.Errorf("opensmtpd: spilling message: %w", err)
+	}
+	end, err := mb.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("opensmtpd: reading spilled message: %w", err)
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(mb.file, 0, end))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("opensmtpd: reading spilled message: %w", err)
+		}
+		if err := fn(line[:len(line)-1]); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Frees the memory and removes the temporary file. Err still reports what
+ * went wrong before. Closing a nil buffer does nothing.
+ */
+func (mb *MessageBuffer) Close() error {
+	if mb == nil {
+		return nil
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if !mb.closed {
+		mb.discard()
+		mb.closed = true
+	}
+	return nil
+}
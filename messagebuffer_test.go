@@ -0,0 +1,88 @@
+package opensmtpd
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func collect(t *testing.T, mb *MessageBuffer) []string {
+	t.Helper()
+	var lines []string
+	err := mb.Each(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestMessageBufferSpills(t *testing.T) {
+	limits := &MessageLimits{MaxMemory: 10, TempDir: t.TempDir()}
+	mb := newMessageBuffer(limits)
+	want := []string{"12345", "67890", "spilled", ""}
+	for _, line := range want {
+		if err := mb.Append(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !mb.Spilled() || mb.Lines() != nil {
+		t.Fatal("the message wasn't spilled")
+	}
+	if got := collect(t, mb); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if size := mb.Size(); size != 25 {
+		t.Errorf("expected a size of 25, got %d", size)
+	}
+
+	mb.Close()
+	if files, _ := os.ReadDir(limits.TempDir); len(files) != 0 {
+		t.Errorf("Close left %d files behind", len(files))
+	}
+}
+
+func TestMessageBufferSharesTotalMemory(t *testing.T) {
+	limits := &MessageLimits{MaxTotalMemory: 10, TempDir: t.TempDir()}
+	first := newMessageBuffer(limits)
+	second := newMessageBuffer(limits)
+	first.Append("1234567")
+	second.Append("1234567")
+	if first.Spilled() || !second.Spilled() {
+		t.Fatal("expected only the second message to be spilled")
+	}
+
+	first.Close()
+	third := newMessageBuffer(limits)
+	third.Append("1234567")
+	if third.Spilled() {
+		t.Error("Close didn't release the memory of the first message")
+	}
+	second.Close()
+	third.Close()
+}
+
+func TestMessageBufferMaxSize(t *testing.T) {
+	limits := &MessageLimits{MaxSize: 10, MaxMemory: 4, TempDir: t.TempDir()}
+	mb := newMessageBuffer(limits)
+	if err := mb.Append("12345"); err != nil {
+		t.Fatal(err)
+	}
+	// 5 bytes and CRLF twice
+	err := mb.Append("12345")
+	var tooLarge *MessageTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Max != 10 {
+		t.Fatalf("expected a *MessageTooLargeError, got %v", err)
+	}
+	if !errors.Is(mb.Err(), err) || !errors.Is(mb.Append("x"), err) {
+		t.Error("the buffer didn't keep the error")
+	}
+	if files, _ := os.ReadDir(limits.TempDir); len(files) != 0 {
+		t.Error("the discarded message is still on disk")
+	}
+	mb.Close()
+}
@@ -0,0 +1,244 @@
+package opensmtpd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var errMessageAborted = errors.New("opensmtpd: message aborted")
+
+/*
+ * A message that is handed to a MessageStreamHandler while it arrives.
+ */
+type messageStream struct {
+	in  *streamPipe
+	out *datalineWriter
+	// bytes of the message, counting line endings as CRLF
+	size int64
+	// set when the input is cut off because the message is too large
+	failed bool
+
+	err  error
+	done chan struct{}
+}
+
+/*
+ * Starts handler on the message of session. Lines are written to the
+ * stream with write; responder answers the message's data-line events.
+ */
+func startMessageStream(handler MessageStreamHandler, session *SMTPSession, responder EventResponder) *messageStream {
+	pipe := newStreamPipe(messageStreamBuffer)
+	ms := &messageStream{
+		in:   pipe,
+		out:  &datalineWriter{responder: responder},
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(ms.done)
+		ms.err = handler.HandleMessageStream(session, pipe, ms.out)
+		ms.out.flush()
+		// unblock the lines that are still being written
+		pipe.closeRead()
+	}()
+	return ms
+}
+
+/*
+ * Passes a dot-unescaped line to the handler. Lines are buffered up to
+ * messageStreamBuffer bytes, beyond that it blocks until the handler has
+ * caught up, so a message never has to be kept in memory. Returns a
+ * *MessageTooLargeError once the message exceeds max, if max isn't 0.
+ */
+func (ms *messageStream) write(line string, max int64) error {
+	if ms.failed {
+		return nil
+	}
+	ms.size += int64(len(line)) + 2
+	if max > 0 && ms.size > max {
+		err := &MessageTooLargeError{Max: max}
+		ms.failed = true
+		ms.in.CloseWithError(err)
+		return err
+	}
+	// the handler may have stopped reading, then the line is dropped
+	if _, err := io.WriteString(ms.in, line); err == nil {
+		io.WriteString(ms.in, "\r\n")
+	}
+	return nil
+}
+
+/*
+ * Ends the message and calls done with the handler's error once the
+ * handler has returned, then ends the message it wrote.
+ */
+func (ms *messageStream) end(done func(err error)) {
+	ms.in.Close()
+	go func() {
+		<-ms.done
+		done(ms.err)
+		ms.out.responder.DatalineEnd()
+	}()
+}
+
+/*
+ * Stops the handler of a message that won't be completed. What it still
+ * writes is dropped.
+ */
+func (ms *messageStream) abort() {
+	ms.out.aborted.Store(true)
+	ms.in.abort(errMessageAborted)
+}
+
+/*
+ * How many bytes of a message are buffered for a MessageStreamHandler that
+ * doesn't keep up.
+ */
+const messageStreamBuffer = 64 * 1024
+
+/*
+ * Like io.Pipe, but buffers up to max bytes, so writing only blocks when the
+ * reader has fallen that far behind.
+ */
+type streamPipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	max  int
+	// returned by Read once buf is drained
+	err        error
+	readClosed bool
+}
+
+func newStreamPipe(max int) *streamPipe {
+	p := &streamPipe{max: max}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *streamPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.buf) == 0 && p.err == nil {
+		p.cond.Wait()
+	}
+	if len(p.buf) == 0 {
+		return 0, p.err
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	if len(p.buf) == 0 {
+		// reuse the storage
+		p.buf = p.buf[:0:cap(p.buf)]
+	}
+	p.cond.Broadcast()
+	return n, nil
+}
+
+func (p *streamPipe) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.buf) >= p.max && !p.readClosed && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.readClosed || p.err != nil {
+		return 0, io.ErrClosedPipe
+	}
+	p.buf = append(p.buf, b...)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+/*
+ * Ends the input. The reader gets the buffered bytes and then err, or
+ * io.EOF if err is nil.
+ */
+func (p *streamPipe) CloseWithError(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+func (p *streamPipe) Close() error {
+	p.CloseWithError(nil)
+	return nil
+}
+
+/*
+ * Like CloseWithError, but drops the buffered bytes.
+ */
+func (p *streamPipe) abort(err error) {
+	p.mu.Lock()
+	p.buf = nil
+	p.mu.Unlock()
+	p.CloseWithError(err)
+}
+
+/*
+ * Called once the reader is done, further writes fail.
+ */
+func (p *streamPipe) closeRead() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readClosed = true
+	p.buf = nil
+	p.cond.Broadcast()
+}
+
+/*
+ * Turns what a MessageStreamHandler writes into data-line responses.
+ */
+type datalineWriter struct {
+	responder EventResponder
+	// an incomplete line
+	buf     []byte
+	aborted atomic.Bool
+}
+
+func (dw *datalineWriter) Write(p []byte) (int, error) {
+	if dw.aborted.Load() {
+		return 0, errMessageAborted
+	}
+	n := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			break
+		}
+		if len(dw.buf) > 0 {
+			dw.buf = append(dw.buf, p[:i]...)
+			dw.reply(string(dw.buf))
+			dw.buf = dw.buf[:0]
+		} else {
+			dw.reply(string(p[:i]))
+		}
+		p = p[i+1:]
+	}
+	dw.buf = append(dw.buf, p...)
+	return n, nil
+}
+
+func (dw *datalineWriter) reply(line string) {
+	dw.responder.DatalineReply(strings.TrimSuffix(line, "\r"))
+}
+
+/*
+ * Sends an incomplete last line.
+ */
+func (dw *datalineWriter) flush() {
+	if len(dw.buf) > 0 && !dw.aborted.Load() {
+		dw.reply(string(dw.buf))
+		dw.buf = dw.buf[:0]
+	}
+}
@@ -0,0 +1,128 @@
+package opensmtpd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type streamingFilter struct {
+	SessionTrackingMixin
+	release chan struct{}
+}
+
+func (f *streamingFilter) GetName() string {
+	return "streaming"
+}
+
+func (f *streamingFilter) HandleMessageStream(session *SMTPSession, r io.Reader, w io.Writer) error {
+	<-f.release
+	_, err := io.Copy(w, r)
+	return err
+}
+
+func TestMessageStreamDoesNotBlockOnSlowHandler(t *testing.T) {
+	f := &streamingFilter{release: make(chan struct{})}
+	fw := NewFilter(f)
+	out := &linePrinter{}
+	f.LinkConnect(fw, event(out, "report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25"))
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 100; i++ {
+			f.Dataline(fw, event(out, fmt.Sprintf("filter|0.7|1.5|smtp-in|data-line|s1|t1|line %d", i)))
+		}
+		f.Dataline(fw, event(out, "filter|0.7|1.5|smtp-in|data-line|s1|t1|."))
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing the message waited for the handler")
+	}
+
+	close(f.release)
+	lines := awaitLines(t, out, 101)
+	for i := 0; i < 100; i++ {
+		if want := fmt.Sprintf("filter-dataline|s1|t1|line %d", i); lines[i] != want {
+			t.Fatalf("line %d: got %q, want %q", i, lines[i], want)
+		}
+	}
+	if lines[100] != "filter-dataline|s1|t1|." {
+		t.Errorf("expected the end of the message, got %q", lines[100])
+	}
+}
+
+func TestStreamPipeBlocksWhenFull(t *testing.T) {
+	p := newStreamPipe(4)
+	if _, err := io.WriteString(p, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(p, "ef")
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("writing to a full pipe didn't block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	buf := make([]byte, 4)
+	if n, _ := p.Read(buf); string(buf[:n]) != "abcd" {
+		t.Errorf("read %q", buf[:n])
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	p.CloseWithError(nil)
+	if rest, err := io.ReadAll(p); err != nil || string(rest) != "ef" {
+		t.Errorf("read %q, %v", rest, err)
+	}
+}
+
+func TestStreamPipeClose(t *testing.T) {
+	p := newStreamPipe(4)
+	io.WriteString(p, "ab")
+	tooLarge := &MessageTooLargeError{Max: 2}
+	p.CloseWithError(tooLarge)
+	if rest, err := io.ReadAll(p); string(rest) != "ab" || !errors.Is(err, tooLarge) {
+		t.Errorf("read %q, %v", rest, err)
+	}
+
+	p = newStreamPipe(4)
+	io.WriteString(p, "ab")
+	p.abort(errMessageAborted)
+	if rest, err := io.ReadAll(p); len(rest) != 0 || !errors.Is(err, errMessageAborted) {
+		t.Errorf("read %q, %v after abort", rest, err)
+	}
+
+	p = newStreamPipe(4)
+	io.WriteString(p, "abcd")
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.WriteString(p, "ef")
+		written <- err
+	}()
+	p.closeRead()
+	if err := <-written; !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected io.ErrClosedPipe, got %v", err)
+	}
+}
+
+func TestDatalineWriterSplitsLines(t *testing.T) {
+	out := &linePrinter{}
+	dw := &datalineWriter{responder: event(out, "filter|0.7|1.5|smtp-in|data-line|s1|t1|x").Responder()}
+	io.WriteString(dw, "a\r\nb")
+	io.WriteString(dw, "c\nd")
+	dw.flush()
+	want := []string{"filter-dataline|s1|t1|a", "filter-dataline|s1|t1|bc", "filter-dataline|s1|t1|d"}
+	if got := out.Lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
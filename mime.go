@@ -0,0 +1,423 @@
+package opensmtpd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+ * Converts text in charset to UTF-8 for MIMEPart.Text and encoded
+ * filenames, for charsets other than UTF-8, US-ASCII, ISO-8859-1,
+ * ISO-8859-15 and Windows-1252. charset.NewReaderLabel from
+ * golang.org/x/net/html/charset is a good choice.
+ */
+var CharsetReader func(charset string, input io.Reader) (io.Reader, error)
+
+/*
+ * A message or one of its MIME parts. The parts of multipart bodies are
+ * parsed along with the message, bodies are only decoded when asked for.
+ */
+type MIMEPart struct {
+	Header Header
+	// the media type in lower case, text/plain if the part doesn't have
+	// a valid Content-Type, and its parameters
+	MediaType string
+	Params    map[string]string
+	// the parts of a multipart body, in order
+	Parts []*MIMEPart
+
+	parent *MIMEPart
+	// whether the header ended with an empty line, and whether the part
+	// had no header at all
+	separator bool
+	bare      bool
+	// the lines of the body as received, for parts that aren't multipart
+	body []string
+	// the lines around the parts of a multipart body, the delimiter lines
+	// as received and whether the last one was a close delimiter
+	preamble   []string
+	epilogue   []string
+	delimiters []string
+	closed     bool
+}
+
+/*
+ * Parses the dot-unescaped lines of a message.
+ */
+func parseMessage(lines []string) *MIMEPart {
+	return parsePart(lines, nil)
+}
+
+func parsePart(lines []string, parent *MIMEPart) *MIMEPart {
+	p := &MIMEPart{parent: parent}
+
+	i := 0
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			p.separator = true
+			i++
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(p.Header.fields) > 0 {
+			f := &p.Header.fields[len(p.Header.fields)-1]
+			f.Lines = append(f.Lines, line)
+			continue
+		}
+		name, _, ok := strings.Cut(line, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			// not a header field, the body starts without an empty line
+			break
+		}
+		p.Header.fields = append(p.Header.fields, HeaderField{Name: name, Lines: []string{line}})
+	}
+	body := lines[i:]
+	p.bare = !p.separator && len(p.Header.fields) == 0
+
+	p.MediaType = "text/plain"
+	if mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type")); err == nil {
+		p.MediaType = mediaType
+		p.Params = params
+	}
+	if p.Params == nil {
+		p.Params = make(map[string]string)
+	}
+
+	boundary := p.Params["boundary"]
+	if !p.IsMultipart() || boundary == "" {
+		p.body = body
+		return p
+	}
+	p.parseParts(body, boundary)
+	return p
+}
+
+/*
+ * Splits a multipart body at the delimiter lines.
+ */
+func (p *MIMEPart) parseParts(body []string, boundary string) {
+	delimiter := "--" + boundary
+	start := -1
+	for i, line := range body {
+		line = strings.TrimRight(line, " \t")
+		if !strings.HasPrefix(line, delimiter) {
+			continue
+		}
+		rest := line[len(delimiter):]
+		if rest != "" && rest != "--" {
+			continue
+		}
+
+		if start < 0 {
+			p.preamble = body[:i]
+		} else {
+			p.Parts = append(p.Parts, parsePart(body[start:i], p))
+		}
+		p.delimiters = append(p.delimiters, body[i])
+		start = i + 1
+		if rest == "--" {
+			p.closed = true
+			p.epilogue = body[i+1:]
+			return
+		}
+	}
+	if start < 0 {
+		// no delimiter at all, keep the body as it is
+		p.body = body
+		return
+	}
+	p.Parts = append(p.Parts, parsePart(body[start:], p))
+}
+
+/*
+ * Appends the lines of the part with its changes to out.
+ */
+func (p *MIMEPart) appendLines(out []string) []string {
+	for _, f := range p.Header.fields {
+		out = append(out, f.Lines...)
+	}
+	if p.separator || (p.bare && len(p.Header.fields) > 0) {
+		out = append(out, "")
+	}
+	if len(p.delimiters) == 0 {
+		return append(out, p.body...)
+	}
+
+	out = append(out, p.preamble...)
+	for i, part := range p.Parts {
+		out = append(out, p.delimiters[i])
+		out = part.appendLines(out)
+	}
+	if p.closed {
+		out = append(out, p.delimiters[len(p.Parts)])
+		out = append(out, p.epilogue...)
+	}
+	return out
+}
+
+func (p *MIMEPart) IsMultipart() bool {
+	return strings.HasPrefix(p.MediaType, "multipart/")
+}
+
+/*
+ * Returns the lines of the body as received. Empty for multipart parts
+ * that were split into parts.
+ */
+func (p *MIMEPart) RawBody() []string {
+	return p.body
+}
+
+/*
+ * Returns the body with its Content-Transfer-Encoding (base64 or
+ * quoted-printable) decoded. Empty for multipart parts that were split
+ * into parts.
+ */
+func (p *MIMEPart) Body() ([]byte, error) {
+	raw := strings.Join(p.body, "\r\n")
+	if p.parent == nil && len(p.body) > 0 {
+		// in a multipart body the last line break belongs to the delimiter
+		// after the part
+		raw += "\r\n"
+	}
+
+	switch p.TransferEncoding() {
+	case "base64":
+		return decodeBase64(raw)
+	case "quoted-printable":
+		b, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			return nil, fmt.Errorf("opensmtpd: decoding quoted-printable: %w", err)
+		}
+		return b, nil
+	default:
+		return []byte(raw), nil
+	}
+}
+
+/*
+ * Decodes base64, ignoring line breaks, other characters outside of the
+ * alphabet and missing padding, like most mail clients do.
+ */
+func decodeBase64(raw string) ([]byte, error) {
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '+', r == '/':
+			return r
+		}
+		return -1
+	}, raw)
+	if len(clean)%4 == 1 {
+		clean = clean[:len(clean)-1]
+	}
+	b, err := base64.RawStdEncoding.DecodeString(clean)
+	if err != nil {
+		return nil, fmt.Errorf("opensmtpd: decoding base64: %w", err)
+	}
+	return b, nil
+}
+
+/*
+ * Returns the decoded body converted from the part's charset to UTF-8.
+ */
+func (p *MIMEPart) Text() (string, error) {
+	b, err := p.Body()
+	if err != nil {
+		return "", err
+	}
+	return decodeCharset(p.Params["charset"], b)
+}
+
+/*
+ * Returns the Content-Transfer-Encoding in lower case, "7bit" if there is
+ * none.
+ */
+func (p *MIMEPart) TransferEncoding() string {
+	cte := strings.ToLower(p.Header.Get("Content-Transfer-Encoding"))
+	if cte == "" {
+		return "7bit"
+	}
+	return cte
+}
+
+/*
+ * Returns the disposition type of the Content-Disposition in lower case,
+ * like "attachment", or "" if there is none.
+ */
+func (p *MIMEPart) Disposition() string {
+	disposition, _, _ := p.disposition()
+	return disposition
+}
+
+func (p *MIMEPart) disposition() (string, map[string]string, error) {
+	value := p.Header.Get("Content-Disposition")
+	if value == "" {
+		return "", nil, nil
+	}
+	return mime.ParseMediaType(value)
+}
+
+/*
+ * Returns the filename from the Content-Disposition or the name from the
+ * Content-Type, with RFC 2231 and RFC 2047 encodings decoded, or "".
+ */
+func (p *MIMEPart) Filename() string {
+	name := ""
+	if _, params, err := p.disposition(); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = p.Params["name"]
+	}
+	decoder := mime.WordDecoder{CharsetReader: charsetReader}
+	if decoded, err := decoder.DecodeHeader(name); err == nil {
+		return decoded
+	}
+	return name
+}
+
+/*
+ * Reports whether the part is an attachment: a part that isn't multipart
+ * and either has the attachment disposition or a filename.
+ */
+func (p *MIMEPart) IsAttachment() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	return p.Disposition() == "attachment" || p.Filename() != ""
+}
+
+/*
+ * Returns the attachments in the part and its descendants, in order.
+ */
+func (p *MIMEPart) Attachments() []*MIMEPart {
+	var attachments []*MIMEPart
+	p.Walk(func(part *MIMEPart) error {
+		if part.IsAttachment() {
+			attachments = append(attachments, part)
+		}
+		return nil
+	})
+	return attachments
+}
+
+/*
+ * Calls fn for the part and its descendants, depth first, until fn returns
+ * an error.
+ */
+func (p *MIMEPart) Walk(fn func(*MIMEPart) error) error {
+	if err := fn(p); err != nil {
+		return err
+	}
+	for _, part := range p.Parts {
+		if err := part.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Converts b from charset to UTF-8.
+ */
+func decodeCharset(charset string, b []byte) (string, error) {
+	charset = strings.ToLower(charset)
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(b), nil
+	}
+	if table, ok := charsets[charset]; ok {
+		var sb strings.Builder
+		sb.Grow(len(b))
+		for _, c := range b {
+			if c < 0x80 {
+				sb.WriteByte(c)
+			} else {
+				sb.WriteRune(table(c))
+			}
+		}
+		return sb.String(), nil
+	}
+	if CharsetReader != nil {
+		r, err := CharsetReader(charset, strings.NewReader(string(b)))
+		if err != nil {
+			return "", err
+		}
+		text, err := io.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		return string(text), nil
+	}
+	return "", fmt.Errorf("opensmtpd: unsupported charset %q", charset)
+}
+
+/*
+ * Lets mime.WordDecoder use the same charsets as decodeCharset.
+ */
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	b, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := decodeCharset(charset, b)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}
+
+/*
+ * Maps the bytes from 0x80 of the single-byte charsets that are decoded
+ * without CharsetReader.
+ */
+var charsets = map[string]func(c byte) rune{
+	"iso-8859-1":   latin1,
+	"latin1":       latin1,
+	"iso-8859-15":  latin9,
+	"windows-1252": windows1252,
+	"cp1252":       windows1252,
+}
+
+func latin1(c byte) rune {
+	return rune(c)
+}
+
+func latin9(c byte) rune {
+	switch c {
+	case 0xa4:
+		return '€'
+	case 0xa6:
+		return 'Š'
+	case 0xa8:
+		return 'š'
+	case 0xb4:
+		return 'Ž'
+	case 0xb8:
+		return 'ž'
+	case 0xbc:
+		return 'Œ'
+	case 0xbd:
+		return 'œ'
+	case 0xbe:
+		return 'Ÿ'
+	}
+	return rune(c)
+}
+
+// 0x80 to 0x9f of Windows-1252, the rest is ISO-8859-1
+var windows1252High = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
+
+func windows1252(c byte) rune {
+	if c < 0xa0 {
+		return windows1252High[c-0x80]
+	}
+	return rune(c)
+}
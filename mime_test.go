@@ -0,0 +1,138 @@
+package opensmtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+var mixedMessage = []string{
+	"From: sender@example.com",
+	"Subject: =?iso-8859-1?q?Gr=FC=DFe?=",
+	`Content-Type: multipart/mixed; boundary="outer"`,
+	"",
+	"preamble",
+	"--outer",
+	`Content-Type: multipart/alternative; boundary="inner"`,
+	"",
+	"--inner",
+	"Content-Type: text/plain; charset=iso-8859-1",
+	"Content-Transfer-Encoding: quoted-printable",
+	"",
+	"Gr=FC=DFe",
+	"--inner",
+	"Content-Type: text/html",
+	"",
+	"<p>hello</p>",
+	"--inner--",
+	"--outer",
+	"Content-Type: application/pdf",
+	"Content-Disposition: attachment;",
+	" filename*=utf-8''r%C3%A9sum%C3%A9.pdf",
+	"Content-Transfer-Encoding: base64",
+	"",
+	"JVBERi0x",
+	"LjQK",
+	"--outer--",
+	"epilogue",
+}
+
+func TestParseMessage(t *testing.T) {
+	msg := parseMessage(mixedMessage)
+
+	if msg.MediaType != "multipart/mixed" || len(msg.Parts) != 2 {
+		t.Fatalf("unexpected message %s with %d parts", msg.MediaType, len(msg.Parts))
+	}
+	if got := msg.Header.Decoded("subject"); got != "Grüße" {
+		t.Errorf("unexpected subject %q", got)
+	}
+
+	alternative := msg.Parts[0]
+	if alternative.MediaType != "multipart/alternative" || len(alternative.Parts) != 2 {
+		t.Fatalf("unexpected first part %s with %d parts", alternative.MediaType, len(alternative.Parts))
+	}
+	text, err := alternative.Parts[0].Text()
+	if err != nil || text != "Grüße" {
+		t.Errorf("unexpected text %q, %v", text, err)
+	}
+
+	attachments := msg.Attachments()
+	if len(attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(attachments))
+	}
+	if name := attachments[0].Filename(); name != "résumé.pdf" {
+		t.Errorf("unexpected filename %q", name)
+	}
+	if body, err := attachments[0].Body(); err != nil || string(body) != "%PDF-1.4\n" {
+		t.Errorf("unexpected body %q, %v", body, err)
+	}
+}
+
+func TestParseMessageRoundTrips(t *testing.T) {
+	tests := map[string][]string{
+		"multipart": mixedMessage,
+		"no header": {"just a body", ""},
+		"no body":   {"Subject: hi"},
+		"folded":    {"Subject: a", "\tlong subject", "", "body"},
+		"unclosed":  {`Content-Type: multipart/mixed; boundary="b"`, "", "--b", "", "part"},
+		"no delimiter": {
+			`Content-Type: multipart/mixed; boundary="b"`, "", "no parts",
+		},
+	}
+	for name, lines := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := parseMessage(lines).appendLines(nil); strings.Join(got, "\n") != strings.Join(lines, "\n") {
+				t.Errorf("got %q, want %q", got, lines)
+			}
+		})
+	}
+}
+
+func TestBodyDecoding(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		text  string
+	}{
+		{"base64 without padding", []string{"Content-Transfer-Encoding: base64", "", "aGVsbG8"}, "hello"},
+		{"base64 with garbage", []string{"Content-Transfer-Encoding: base64", "", "aGVs*bG8=", "  "}, "hello"},
+		{"quoted-printable soft breaks", []string{"Content-Transfer-Encoding: quoted-printable", "", "hel=", "lo"}, "hello\r\n"},
+		{"windows-1252", []string{"Content-Type: text/plain; charset=windows-1252", "Content-Transfer-Encoding: quoted-printable", "", "=80"}, "€\r\n"},
+		{"7bit", []string{"", "hello"}, "hello\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, err := parseMessage(tt.lines).Text()
+			if err != nil || text != tt.text {
+				t.Errorf("got %q, %v, want %q", text, err, tt.text)
+			}
+		})
+	}
+}
+
+func TestParsedMessageReadsSpilledBody(t *testing.T) {
+	s := &SMTPSession{Body: newMessageBuffer(&MessageLimits{MaxMemory: 1, TempDir: t.TempDir()})}
+	defer s.Body.Close()
+	for _, line := range []string{"Subject: spilled", "", "body"} {
+		if err := s.Body.Append(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !s.Body.Spilled() {
+		t.Fatal("the message wasn't spilled")
+	}
+	if lines, err := s.MessageLines(); err != nil || strings.Join(lines, "\n") != "Subject: spilled\n\nbody" {
+		t.Errorf("unexpected lines %q, %v", lines, err)
+	}
+
+	msg, err := s.ParsedMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := msg.Header.Get("Subject"); subject != "spilled" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if again, _ := s.ParsedMessage(); again != msg {
+		t.Error("the message was parsed twice")
+	}
+}
@@ -0,0 +1,277 @@
+package opensmtpdtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	opensmtpd "github.com/jdelic/opensmtpd-filters-go"
+)
+
+/*
+ * Describes the input GenerateInput produces.
+ */
+type Workload struct {
+	// number of sessions, each delivering one message
+	Sessions int
+	// recipients per message
+	Recipients int
+	// lines of message data, including the header
+	MessageLines int
+	// protocol version of the events, "0.7" if empty
+	Version string
+}
+
+/*
+ * The workloads BenchmarkSuite runs.
+ */
+var Workloads = map[string]Workload{
+	"small-messages":  {Sessions: 100, Recipients: 1, MessageLines: 20},
+	"many-recipients": {Sessions: 20, Recipients: 50, MessageLines: 20},
+	"large-messages":  {Sessions: 5, Recipients: 2, MessageLines: 20000},
+}
+
+/*
+ * Generates what OpenSMTPD sends to a filter for w: the config handshake
+ * followed by the report and filter events of every session, one session
+ * after the other.
+ */
+func GenerateInput(w Workload) []byte {
+	version := w.Version
+	if version == "" {
+		version = "0.7"
+	}
+	g := &generator{
+		version: version,
+	}
+
+	g.line("config|smtpd-version|7.4.0")
+	g.line("config|protocol|" + version)
+	g.line("config|smtp-session-timeout|300")
+	g.line("config|subsystem|smtp-in")
+	g.line("config|ready")
+	for i := 0; i < w.Sessions; i++ {
+		g.session(w)
+	}
+	return g.buf.Bytes()
+}
+
+type generator struct {
+	buf     bytes.Buffer
+	version string
+	ts      int64
+	nextId  int
+}
+
+func (g *generator) line(line string) {
+	g.buf.WriteString(line)
+	g.buf.WriteByte('\n')
+}
+
+func (g *generator) newId() string {
+	g.nextId++
+	return fmt.Sprintf("%016x", g.nextId)
+}
+
+func (g *generator) report(sid, event string, params ...string) {
+	g.ts++
+	g.line(fmt.Sprintf("report|%s|%d.000000|smtp-in|%s|%s%s", g.version, 1600000000+g.ts, event, sid, joinParams(params)))
+}
+
+func (g *generator) filter(sid, phase string, params ...string) {
+	g.filterToken(sid, phase, g.newId(), params...)
+}
+
+/*
+ * Sends a filter event with the given token. smtpd uses the same token for
+ * all data-lines of a message.
+ */
+func (g *generator) filterToken(sid, phase, token string, params ...string) {
+	g.ts++
+	g.line(fmt.Sprintf("filter|%s|%d.000000|smtp-in|%s|%s|%s%s", g.version, 1600000000+g.ts, phase, sid, token, joinParams(params)))
+}
+
+func joinParams(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return "|" + strings.Join(params, "|")
+}
+
+/*
+ * Returns the parameters of a tx-mail or tx-rcpt report in the order of
+ * the protocol version.
+ */
+func (g *generator) txParams(msgid, address string) []string {
+	if minorVersion(g.version) < 6 {
+		return []string{msgid, address, "ok"}
+	}
+	return []string{msgid, "ok", address}
+}
+
+func (g *generator) session(w Workload) {
+	sid := g.newId()
+	msgid := g.newId()[8:]
+	src := fmt.Sprintf("192.0.2.%d:%d", g.nextId%250+1, 1024+g.nextId%60000)
+
+	g.report(sid, "link-connect", "mail.example.com", "pass", src, "192.0.2.25:25")
+	g.filter(sid, "connect", "mail.example.com", src)
+	g.report(sid, "link-greeting", "mx.example.org")
+	g.filter(sid, "ehlo", "mail.example.com")
+	if minorVersion(g.version) < 5 {
+		g.report(sid, "link-identify", "mail.example.com")
+	} else {
+		g.report(sid, "link-identify", "EHLO", "mail.example.com")
+	}
+	g.report(sid, "protocol-client", "EHLO mail.example.com")
+	g.report(sid, "protocol-server", "250-mx.example.org Hello mail.example.com [192.0.2.1], pleased to meet you")
+
+	g.report(sid, "tx-begin", msgid)
+	g.filter(sid, "mail-from", "<sender@example.com>")
+	g.report(sid, "tx-mail", g.txParams(msgid, "sender@example.com")...)
+	for i := 0; i < w.Recipients; i++ {
+		rcpt := fmt.Sprintf("rcpt%d@example.org", i)
+		g.filter(sid, "rcpt-to", "<"+rcpt+">")
+		g.report(sid, "tx-rcpt", g.txParams(msgid, rcpt)...)
+	}
+	g.filter(sid, "data")
+	g.report(sid, "tx-data", msgid, "ok")
+
+	size := 0
+	token := g.newId()
+	for i := 0; i < w.MessageLines; i++ {
+		var line string
+		switch {
+		case i == 0:
+			line = "From: Sender <sender@example.com>"
+		case i == 1:
+			line = "Subject: benchmark message " + msgid
+		case i == 2:
+			line = ""
+		case i%50 == 0:
+			// a line that needs dot-stuffing and one with the separator
+			line = ".. | quoted"
+		default:
+			line = "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod."
+		}
+		size += len(line) + 2
+		g.filterToken(sid, "data-line", token, line)
+	}
+	g.filterToken(sid, "data-line", token, ".")
+	g.filter(sid, "commit")
+	g.report(sid, "tx-commit", msgid, fmt.Sprint(size))
+	g.report(sid, "tx-reset", msgid)
+	g.filter(sid, "quit")
+	g.report(sid, "link-disconnect")
+}
+
+/*
+ * Extracts the lines OpenSMTPD sent from a transcript recorded with
+ * opensmtpd.WithTranscript, for use as benchmark input.
+ */
+func TranscriptInput(transcript io.Reader) ([]byte, error) {
+	var input bytes.Buffer
+	scanner := bufio.NewScanner(transcript)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) == 3 && fields[1] == opensmtpd.TranscriptInput {
+			input.WriteString(fields[2])
+			input.WriteByte('\n')
+		}
+	}
+	return input.Bytes(), scanner.Err()
+}
+
+/*
+ * Runs a filter created by newFilter on input b.N times and reports the
+ * throughput in lines per second. Like smtpd, it only sends the events the
+ * filter registers for. input starts with the config handshake, like the
+ * output of GenerateInput or TranscriptInput.
+ */
+func Benchmark(b *testing.B, newFilter func() opensmtpd.FilterWrapper, input []byte, opts ...opensmtpd.RuntimeOption) {
+	b.Helper()
+
+	input, lines, err := registeredInput(newFilter(), input)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fw := newFilter()
+		b.StartTimer()
+
+		err := opensmtpd.NewRuntime(fw, bytes.NewReader(input), io.Discard, opts...).Run(context.Background())
+		if !errors.Is(err, opensmtpd.ErrInputClosed) {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(lines)*float64(b.N)/b.Elapsed().Seconds(), "lines/s")
+}
+
+/*
+ * Runs Benchmark for every workload in Workloads as a sub-benchmark.
+ */
+func BenchmarkSuite(b *testing.B, newFilter func() opensmtpd.FilterWrapper, opts ...opensmtpd.RuntimeOption) {
+	names := make([]string, 0, len(Workloads))
+	for name := range Workloads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		input := GenerateInput(Workloads[name])
+		b.Run(name, func(b *testing.B) {
+			Benchmark(b, newFilter, input, opts...)
+		})
+	}
+}
+
+/*
+ * Drops the events of input that fw doesn't register for and returns the
+ * remaining input with its number of lines.
+ */
+func registeredInput(fw opensmtpd.FilterWrapper, input []byte) ([]byte, int, error) {
+	i := bytes.Index(input, []byte("config|ready\n"))
+	if i < 0 {
+		return nil, 0, errors.New("input has no config handshake")
+	}
+	handshake := input[:i+len("config|ready\n")]
+
+	var out bytes.Buffer
+	err := opensmtpd.NewRuntime(fw, bytes.NewReader(handshake), &out).Run(context.Background())
+	if !errors.Is(err, opensmtpd.ErrInputClosed) {
+		return nil, 0, err
+	}
+	registered := make(map[string]bool)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if atoms := strings.Split(line, "|"); len(atoms) == 4 && atoms[0] == "register" {
+			// type|subsystem|event, as in the events
+			registered[atoms[1]+"|"+atoms[2]+"|"+atoms[3]] = true
+		}
+	}
+
+	filtered := bytes.NewBuffer(append([]byte{}, handshake...))
+	lines := bytes.Count(handshake, []byte("\n"))
+	for _, line := range bytes.SplitAfter(input[len(handshake):], []byte("\n")) {
+		atoms := bytes.SplitN(line, []byte("|"), 6)
+		if len(atoms) < 6 {
+			continue
+		}
+		key := string(atoms[0]) + "|" + string(atoms[3]) + "|" + string(atoms[4])
+		if registered[key] {
+			filtered.Write(line)
+			lines++
+		}
+	}
+	return filtered.Bytes(), lines, nil
+}
@@ -0,0 +1,69 @@
+package opensmtpdtest_test
+
+import (
+	"strings"
+	"testing"
+
+	opensmtpd "github.com/jdelic/opensmtpd-filters-go"
+	"github.com/jdelic/opensmtpd-filters-go/opensmtpdtest"
+)
+
+type collectingFilter struct {
+	opensmtpd.SessionTrackingMixin
+}
+
+func (f *collectingFilter) GetName() string {
+	return "collecting"
+}
+
+func newRcptFilter() opensmtpd.FilterWrapper {
+	return opensmtpd.NewFilter(nil).OnFilter("rcpt-to", func(fw opensmtpd.FilterWrapper, ev opensmtpd.FilterEvent) {
+		ev.Responder().Proceed()
+	})
+}
+
+func newCollectingFilter() opensmtpd.FilterWrapper {
+	return opensmtpd.NewFilter(&collectingFilter{})
+}
+
+func BenchmarkRcptFilter(b *testing.B) {
+	opensmtpdtest.BenchmarkSuite(b, newRcptFilter)
+}
+
+func BenchmarkSessionTracking(b *testing.B) {
+	opensmtpdtest.BenchmarkSuite(b, newCollectingFilter)
+}
+
+func BenchmarkSessionTrackingWithWorkers(b *testing.B) {
+	opensmtpdtest.BenchmarkSuite(b, newCollectingFilter, opensmtpd.WithWorkers(4))
+}
+
+func BenchmarkChain(b *testing.B) {
+	opensmtpdtest.BenchmarkSuite(b, func() opensmtpd.FilterWrapper {
+		return opensmtpd.NewChain(newRcptFilter(), newCollectingFilter())
+	})
+}
+
+func TestGenerateInputUsesOneTokenPerMessage(t *testing.T) {
+	input := opensmtpdtest.GenerateInput(opensmtpdtest.Workload{Sessions: 3, Recipients: 1, MessageLines: 10})
+
+	tokens := make(map[string]map[string]bool)
+	for _, line := range strings.Split(string(input), "\n") {
+		atoms := strings.SplitN(line, "|", 8)
+		if len(atoms) < 7 || atoms[4] != "data-line" {
+			continue
+		}
+		if tokens[atoms[5]] == nil {
+			tokens[atoms[5]] = make(map[string]bool)
+		}
+		tokens[atoms[5]][atoms[6]] = true
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("expected data-lines of 3 sessions, got %d", len(tokens))
+	}
+	for sid, seen := range tokens {
+		if len(seen) != 1 {
+			t.Errorf("session %s used %d tokens for its data-lines", sid, len(seen))
+		}
+	}
+}
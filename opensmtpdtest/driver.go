@@ -0,0 +1,428 @@
+/*
+ * Package opensmtpdtest drives a FilterWrapper the way OpenSMTPD would, so
+ * filters can be tested without smtpd. A Driver runs the filter on a
+ * Runtime, sends the config handshake, records what the filter registers
+ * for and then sends events and collects the filter's responses:
+ *
+ *	d := opensmtpdtest.NewDriver(t, opensmtpd.NewFilter(&MyFilter{}))
+ *	s := d.Connect("mail.example.com", "192.0.2.1:4321")
+ *	s.Helo("mail.example.com")
+ *	s.MailFrom("sender@example.com")
+ *	if res := s.Rcpt("rcpt@example.org"); res.Verb != "reject" {
+ *		t.Errorf("expected a reject, got %v", res)
+ *	}
+ */
+package opensmtpdtest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	opensmtpd "github.com/jdelic/opensmtpd-filters-go"
+)
+
+/*
+ * One line written by the filter. Verb and Param are only set for
+ * filter-result lines, Line only for filter-dataline lines.
+ */
+type Response struct {
+	Type      string
+	SessionId string
+	Token     string
+	Verb      string
+	Param     string
+	Line      string
+}
+
+func (r Response) String() string {
+	if r.Type == "filter-dataline" {
+		return fmt.Sprintf("%s|%s|%s|%s", r.Type, r.SessionId, r.Token, r.Line)
+	}
+	if r.Param == "" {
+		return fmt.Sprintf("%s|%s|%s|%s", r.Type, r.SessionId, r.Token, r.Verb)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%s", r.Type, r.SessionId, r.Token, r.Verb, r.Param)
+}
+
+type Option func(*Driver)
+
+/*
+ * Sends key|value in the config handshake, in addition to smtpd-version,
+ * protocol and subsystem.
+ */
+func WithConfig(key, value string) Option {
+	return func(d *Driver) {
+		d.config = append(d.config, key+"|"+value)
+	}
+}
+
+/*
+ * Uses version for all events instead of 0.7.
+ */
+func WithProtocolVersion(version string) Option {
+	return func(d *Driver) {
+		d.version = version
+	}
+}
+
+/*
+ * Passes opts to the Runtime that runs the filter.
+ */
+func WithRuntimeOptions(opts ...opensmtpd.RuntimeOption) Option {
+	return func(d *Driver) {
+		d.runtimeOpts = append(d.runtimeOpts, opts...)
+	}
+}
+
+/*
+ * How long to wait for a response before failing the test. The default is
+ * 5 seconds.
+ */
+func WithTimeout(timeout time.Duration) Option {
+	return func(d *Driver) {
+		d.timeout = timeout
+	}
+}
+
+/*
+ * Plays OpenSMTPD for one filter. Its methods must be called from the test's
+ * goroutine.
+ */
+type Driver struct {
+	t           testing.TB
+	version     string
+	config      []string
+	runtimeOpts []opensmtpd.RuntimeOption
+	timeout     time.Duration
+
+	in       *io.PipeWriter
+	output   chan Response
+	runErr   chan error
+	cancel   context.CancelFunc
+	closed   bool
+	register map[string]map[string]bool
+
+	// the timestamp of the next event
+	clock time.Time
+
+	mu        sync.Mutex
+	responses []Response
+	// responses read while waiting for a different one
+	unclaimed []Response
+
+	nextId int
+}
+
+/*
+ * Starts fw on a Runtime, completes the config handshake and waits until
+ * the filter has registered. The filter is stopped when the test ends.
+ */
+func NewDriver(t testing.TB, fw opensmtpd.FilterWrapper, opts ...Option) *Driver {
+	t.Helper()
+
+	d := &Driver{
+		t:        t,
+		version:  "0.7",
+		timeout:  5 * time.Second,
+		output:   make(chan Response, 1024),
+		runErr:   make(chan error, 1),
+		register: make(map[string]map[string]bool),
+		clock:    time.Unix(1600000000, 0),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	d.in = inW
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	go func() {
+		err := opensmtpd.NewRuntime(fw, inR, outW, d.runtimeOpts...).Run(ctx)
+		outW.Close()
+		d.runErr <- err
+	}()
+
+	registered := make(chan error, 1)
+	responses := make(chan Response)
+	go d.readOutput(outR, responses, registered)
+	go d.relay(responses)
+
+	d.Send("config|smtpd-version|7.4.0")
+	d.Send("config|protocol|" + d.version)
+	d.Send("config|smtp-session-timeout|300")
+	d.Send("config|subsystem|smtp-in")
+	for _, line := range d.config {
+		d.Send("config|" + line)
+	}
+	d.Send("config|ready")
+
+	select {
+	case err := <-registered:
+		if err != nil {
+			t.Fatalf("filter didn't register: %v", err)
+		}
+	case <-time.After(d.timeout):
+		t.Fatalf("filter didn't register within %v", d.timeout)
+	}
+
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *Driver) readOutput(out io.Reader, responses chan<- Response, registered chan<- error) {
+	defer close(responses)
+
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	ready := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !ready {
+			atoms := strings.Split(line, "|")
+			switch {
+			case line == "register|ready":
+				ready = true
+				registered <- nil
+			case len(atoms) == 4 && atoms[0] == "register" && atoms[2] == "smtp-in":
+				if d.register[atoms[1]] == nil {
+					d.register[atoms[1]] = make(map[string]bool)
+				}
+				d.register[atoms[1]][atoms[3]] = true
+			}
+			continue
+		}
+
+		r := d.parseResponse(line)
+		d.mu.Lock()
+		d.responses = append(d.responses, r)
+		d.mu.Unlock()
+		responses <- r
+	}
+	if !ready {
+		registered <- errors.New("output closed before register|ready")
+	}
+}
+
+/*
+ * Passes responses on to d.output without ever blocking the filter, which
+ * may write back a whole message before the test reads it, like a filter
+ * streaming a message does.
+ */
+func (d *Driver) relay(responses <-chan Response) {
+	defer close(d.output)
+
+	var queue []Response
+	for responses != nil || len(queue) > 0 {
+		var output chan<- Response
+		var next Response
+		if len(queue) > 0 {
+			output = d.output
+			next = queue[0]
+		}
+		select {
+		case r, ok := <-responses:
+			if !ok {
+				responses = nil
+				continue
+			}
+			queue = append(queue, r)
+		case output <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
+func (d *Driver) parseResponse(line string) Response {
+	atoms := strings.SplitN(line, "|", 4)
+	for len(atoms) < 4 {
+		atoms = append(atoms, "")
+	}
+	r := Response{
+		Type:      atoms[0],
+		SessionId: atoms[1],
+		Token:     atoms[2],
+	}
+	if d.oldResponseOrder() {
+		r.SessionId, r.Token = r.Token, r.SessionId
+	}
+
+	if r.Type == "filter-dataline" {
+		r.Line = atoms[3]
+	} else {
+		r.Verb, r.Param, _ = strings.Cut(atoms[3], "|")
+	}
+	return r
+}
+
+/*
+ * Protocol versions up to 0.5 put the token before the session id in
+ * responses.
+ */
+func (d *Driver) oldResponseOrder() bool {
+	return d.minorVersion() <= 5
+}
+
+func (d *Driver) minorVersion() int {
+	return minorVersion(d.version)
+}
+
+/*
+ * Returns x of protocol version 0.x.
+ */
+func minorVersion(version string) int {
+	_, minor, _ := strings.Cut(version, ".")
+	mi, _ := strconv.Atoi(minor)
+	return mi
+}
+
+/*
+ * Reports whether the filter registered for the smtp-in event of type typ
+ * ("report" or "filter").
+ */
+func (d *Driver) Registered(typ, event string) bool {
+	return d.register[typ][event]
+}
+
+/*
+ * Returns every response the filter has written so far, in order.
+ */
+func (d *Driver) Responses() []Response {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Response(nil), d.responses...)
+}
+
+/*
+ * Moves the timestamp of the following events forward.
+ */
+func (d *Driver) Advance(dur time.Duration) {
+	d.clock = d.clock.Add(dur)
+}
+
+func (d *Driver) timestamp() string {
+	return fmt.Sprintf("%d.%06d", d.clock.Unix(), d.clock.Nanosecond()/1000)
+}
+
+/*
+ * Sends a raw protocol line to the filter.
+ */
+func (d *Driver) Send(line string) {
+	d.t.Helper()
+	if _, err := io.WriteString(d.in, line+"\n"); err != nil {
+		d.t.Fatalf("sending %q: %v", line, err)
+	}
+}
+
+/*
+ * Sends a report event, if the filter registered for it.
+ */
+func (d *Driver) Report(sessionId, event string, params ...string) {
+	d.t.Helper()
+	if !d.Registered("report", event) {
+		return
+	}
+	atoms := append([]string{"report", d.version, d.timestamp(), "smtp-in", event, sessionId}, params...)
+	d.Send(strings.Join(atoms, "|"))
+}
+
+/*
+ * Sends a filter event and waits for its filter-result. If the filter didn't
+ * register for the phase, nothing is sent and the result is a proceed, as
+ * smtpd would do.
+ */
+func (d *Driver) Filter(sessionId, phase string, params ...string) Response {
+	d.t.Helper()
+	token := d.newId()
+	if !d.Registered("filter", phase) {
+		return Response{Type: "filter-result", SessionId: sessionId, Token: token, Verb: "proceed"}
+	}
+	atoms := append([]string{"filter", d.version, d.timestamp(), "smtp-in", phase, sessionId, token}, params...)
+	d.Send(strings.Join(atoms, "|"))
+	return d.Await("filter-result", sessionId, token)
+}
+
+/*
+ * Waits for the next response of type typ for the session and token and
+ * fails the test if none arrives in time.
+ */
+func (d *Driver) Await(typ, sessionId, token string) Response {
+	d.t.Helper()
+
+	match := func(r Response) bool {
+		return r.Type == typ && r.SessionId == sessionId && r.Token == token
+	}
+	for i, r := range d.unclaimed {
+		if match(r) {
+			d.unclaimed = append(d.unclaimed[:i], d.unclaimed[i+1:]...)
+			return r
+		}
+	}
+
+	timeout := time.After(d.timeout)
+	for {
+		select {
+		case r, ok := <-d.output:
+			if !ok {
+				d.t.Fatalf("filter stopped while waiting for %s of session %s: %v",
+					typ, sessionId, d.stop())
+			}
+			if match(r) {
+				return r
+			}
+			d.unclaimed = append(d.unclaimed, r)
+		case <-timeout:
+			d.t.Fatalf("no %s for session %s and token %s within %v", typ, sessionId, token, d.timeout)
+		}
+	}
+}
+
+func (d *Driver) newId() string {
+	d.nextId++
+	return fmt.Sprintf("%016x", d.nextId)
+}
+
+/*
+ * Closes the filter's input and waits for it to stop. A run error other than
+ * opensmtpd.ErrInputClosed fails the test. Called automatically when the
+ * test ends.
+ */
+func (d *Driver) Close() {
+	d.t.Helper()
+	if d.closed {
+		return
+	}
+	if err := d.stop(); err != nil && !errors.Is(err, opensmtpd.ErrInputClosed) {
+		d.t.Errorf("filter failed: %v", err)
+	}
+}
+
+func (d *Driver) stop() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	d.in.Close()
+
+	var err error
+	select {
+	case err = <-d.runErr:
+	case <-time.After(d.timeout):
+		d.cancel()
+		err = <-d.runErr
+	}
+	// drain the output, so the reader goroutine exits
+	for range d.output {
+	}
+	return err
+}
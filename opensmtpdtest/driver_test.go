@@ -0,0 +1,143 @@
+package opensmtpdtest_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	opensmtpd "github.com/jdelic/opensmtpd-filters-go"
+	"github.com/jdelic/opensmtpd-filters-go/opensmtpdtest"
+)
+
+/*
+ * Records the lines of the events a filter received.
+ */
+type recorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *recorder) record(fw opensmtpd.FilterWrapper, ev opensmtpd.FilterEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, strings.Join(ev.GetAtoms(), "|"))
+}
+
+/*
+ * Returns the events received so far, split into their atoms.
+ */
+func (r *recorder) Events() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events [][]string
+	for _, line := range r.lines {
+		events = append(events, strings.Split(line, "|"))
+	}
+	return events
+}
+
+func TestDriverHandshake(t *testing.T) {
+	rec := &recorder{}
+	fw := opensmtpd.NewFilter(nil).OnFilter("helo", func(fw opensmtpd.FilterWrapper, ev opensmtpd.FilterEvent) {
+		rec.record(fw, ev)
+		ev.Responder().Proceed()
+	})
+	d := opensmtpdtest.NewDriver(t, fw, opensmtpdtest.WithConfig("admd", "example.org"))
+
+	if !d.Registered("filter", "helo") || d.Registered("filter", "rcpt-to") || d.Registered("report", "link-connect") {
+		t.Error("the driver didn't record the registered events")
+	}
+	config := fw.GetConfig()
+	if config == nil || config.Admd != "example.org" || config.ProtocolVersion != "0.7" || config.Subsystem != "smtp-in" {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	d.Connect("mail.example.com", "192.0.2.1:4321").Helo("mail.example.com")
+	if events := rec.Events(); len(events) != 1 || events[0][7] != "mail.example.com" {
+		t.Errorf("expected one helo, got %d events", len(events))
+	}
+}
+
+func TestDriverUsesOneTokenPerFilterRequest(t *testing.T) {
+	rec := &recorder{}
+	fw := opensmtpd.NewFilter(nil)
+	for _, phase := range []string{"helo", "mail-from", "rcpt-to"} {
+		fw.OnFilter(phase, func(fw opensmtpd.FilterWrapper, ev opensmtpd.FilterEvent) {
+			rec.record(fw, ev)
+			ev.Responder().Proceed()
+		})
+	}
+	d := opensmtpdtest.NewDriver(t, fw)
+	s := d.Connect("mail.example.com", "192.0.2.1:4321")
+	s.Helo("mail.example.com")
+	s.MailFrom("sender@example.com")
+	s.Rcpt("a@example.org")
+	s.Rcpt("b@example.org")
+
+	events := rec.Events()
+	responses := d.Responses()
+	if len(events) != 4 || len(responses) != 4 {
+		t.Fatalf("expected 4 events and responses, got %d and %d", len(events), len(responses))
+	}
+	tokens := make(map[string]bool)
+	for i, ev := range events {
+		token := ev[6]
+		if tokens[token] {
+			t.Errorf("token %s was used twice", token)
+		}
+		tokens[token] = true
+		if responses[i].Token != token || responses[i].SessionId != s.Id {
+			t.Errorf("response %v doesn't answer %s of session %s", responses[i], token, s.Id)
+		}
+	}
+}
+
+func TestDriverPassesDatalinesThrough(t *testing.T) {
+	d := opensmtpdtest.NewDriver(t, newCollectingFilter())
+	s := d.Connect("mail.example.com", "192.0.2.1:4321")
+	s.MailFrom("sender@example.com")
+	s.Rcpt("rcpt@example.org")
+
+	msg := s.Data("Subject: hi\r\n\r\n.leading dot\r\nbody\r\n")
+	if want := []string{"Subject: hi", "", ".leading dot", "body"}; strings.Join(msg.Lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", msg.Lines, want)
+	}
+	if msg.DataResult.Verb != "proceed" || msg.CommitResult.Verb != "proceed" {
+		t.Errorf("unexpected results %v, %v", msg.DataResult, msg.CommitResult)
+	}
+
+	var datalines []string
+	for _, r := range d.Responses() {
+		if r.Type == "filter-dataline" {
+			datalines = append(datalines, r.Line)
+		}
+	}
+	if want := []string{"Subject: hi", "", "..leading dot", "body", "."}; strings.Join(datalines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got data-lines %q, want %q", datalines, want)
+	}
+}
+
+func TestDriverReadsVerdicts(t *testing.T) {
+	fw := opensmtpd.NewFilter(nil).OnFilter("mail-from", func(fw opensmtpd.FilterWrapper, ev opensmtpd.FilterEvent) {
+		_ = ev.Responder().Rewrite("rewritten@example.com")
+	}).OnFilter("rcpt-to", func(fw opensmtpd.FilterWrapper, ev opensmtpd.FilterEvent) {
+		ev.Responder().HardReject("5.1.1 no such user")
+	})
+
+	for _, version := range []string{"0.5", "0.7"} {
+		t.Run(version, func(t *testing.T) {
+			d := opensmtpdtest.NewDriver(t, fw, opensmtpdtest.WithProtocolVersion(version))
+			s := d.Connect("mail.example.com", "192.0.2.1:4321")
+
+			if res := s.MailFrom("sender@example.com"); res.Verb != "rewrite" || res.Param != "rewritten@example.com" || res.SessionId != s.Id {
+				t.Errorf("unexpected result %v", res)
+			}
+			if res := s.Rcpt("rcpt@example.org"); res.Verb != "reject" || res.Param != "550 5.1.1 no such user" || res.SessionId != s.Id {
+				t.Errorf("unexpected result %v", res)
+			}
+			if res := s.Helo("mail.example.com"); res.Verb != "proceed" || len(d.Responses()) != 2 {
+				t.Errorf("an unregistered phase wasn't answered with proceed by the driver: %v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package opensmtpdtest
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ * One simulated SMTP session. Its methods send the report and filter events
+ * smtpd sends for the corresponding SMTP commands, skipping the events the
+ * filter didn't register for, and return the filter's verdict.
+ */
+type Session struct {
+	d     *Driver
+	Id    string
+	MsgId string
+
+	// the filter's answer to the connect phase
+	ConnectResult Response
+}
+
+/*
+ * The outcome of Session.Data.
+ */
+type Message struct {
+	// the message as written back by the filter, with leading dots
+	// unescaped
+	Lines []string
+	// the filter's answer to the data phase
+	DataResult Response
+	// the filter's answer to the commit phase
+	CommitResult Response
+}
+
+/*
+ * Opens a session from src (like "192.0.2.1:4321") whose reverse DNS is
+ * rdns.
+ */
+func (d *Driver) Connect(rdns, src string) *Session {
+	d.t.Helper()
+
+	s := &Session{
+		d:  d,
+		Id: d.newId(),
+	}
+	d.Report(s.Id, "link-connect", rdns, "pass", src, "192.0.2.25:25")
+	s.ConnectResult = d.Filter(s.Id, "connect", rdns, src)
+	if accepted(s.ConnectResult) {
+		d.Report(s.Id, "link-greeting", "mx.example.org")
+	}
+	return s
+}
+
+func accepted(r Response) bool {
+	switch r.Verb {
+	case "proceed", "junk", "rewrite", "report":
+		return true
+	}
+	return false
+}
+
+/*
+ * Returns the parameter smtpd continues with: the rewritten one if the
+ * filter rewrote it.
+ */
+func effectiveParam(r Response, param string) string {
+	if r.Verb == "rewrite" {
+		return r.Param
+	}
+	return param
+}
+
+func (s *Session) Helo(name string) Response {
+	s.d.t.Helper()
+	return s.identify("helo", "HELO", name)
+}
+
+func (s *Session) Ehlo(name string) Response {
+	s.d.t.Helper()
+	return s.identify("ehlo", "EHLO", name)
+}
+
+func (s *Session) identify(phase, method, name string) Response {
+	res := s.d.Filter(s.Id, phase, name)
+	if accepted(res) {
+		s.d.Report(s.Id, "link-identify", method, effectiveParam(res, name))
+	}
+	return res
+}
+
+/*
+ * Reports a successful TLS handshake.
+ */
+func (s *Session) StartTLS() Response {
+	s.d.t.Helper()
+	res := s.d.Filter(s.Id, "starttls")
+	if accepted(res) {
+		s.d.Report(s.Id, "link-tls", "version=TLSv1.3, cipher=TLS_AES_256_GCM_SHA384, bits=256")
+	}
+	return res
+}
+
+/*
+ * Reports an authentication attempt for username with result "pass" or
+ * "fail".
+ */
+func (s *Session) Auth(username, result string) Response {
+	s.d.t.Helper()
+	res := s.d.Filter(s.Id, "auth", "PLAIN")
+	if accepted(res) {
+		if s.d.minorVersion() < 6 {
+			s.d.Report(s.Id, "link-auth", username, result)
+		} else {
+			s.d.Report(s.Id, "link-auth", result, username)
+		}
+	}
+	return res
+}
+
+/*
+ * Starts a transaction if none is open yet and sends MAIL FROM.
+ */
+func (s *Session) MailFrom(address string) Response {
+	s.d.t.Helper()
+	if s.MsgId == "" {
+		s.MsgId = s.d.newId()[8:]
+		s.d.Report(s.Id, "tx-begin", s.MsgId)
+	}
+	res := s.d.Filter(s.Id, "mail-from", address)
+	s.reportTx("tx-mail", txResult(res), effectiveParam(res, address))
+	return res
+}
+
+func (s *Session) Rcpt(address string) Response {
+	s.d.t.Helper()
+	res := s.d.Filter(s.Id, "rcpt-to", address)
+	s.reportTx("tx-rcpt", txResult(res), effectiveParam(res, address))
+	return res
+}
+
+/*
+ * Sends tx-mail or tx-rcpt, whose parameter order changed in protocol
+ * version 0.6.
+ */
+func (s *Session) reportTx(event, result, address string) {
+	if s.d.minorVersion() < 6 {
+		s.d.Report(s.Id, event, s.MsgId, address, result)
+	} else {
+		s.d.Report(s.Id, event, s.MsgId, result, address)
+	}
+}
+
+func txResult(r Response) string {
+	if accepted(r) {
+		return "ok"
+	}
+	if strings.HasPrefix(r.Param, "4") {
+		return "tempfail"
+	}
+	return "permfail"
+}
+
+/*
+ * Sends DATA, the message msg line by line and commits the transaction.
+ * Lines may end in "\n" or "\r\n". If the filter rejects DATA, no message
+ * is sent.
+ */
+func (s *Session) Data(msg string) Message {
+	s.d.t.Helper()
+
+	var m Message
+	m.DataResult = s.d.Filter(s.Id, "data")
+	s.d.Report(s.Id, "tx-data", s.MsgId, txResult(m.DataResult))
+	if !accepted(m.DataResult) {
+		return m
+	}
+
+	msg = strings.ReplaceAll(msg, "\r\n", "\n")
+	lines := strings.Split(strings.TrimSuffix(msg, "\n"), "\n")
+	if s.d.Registered("filter", "data-line") {
+		m.Lines = s.sendDatalines(lines)
+	} else {
+		m.Lines = lines
+	}
+
+	size := 0
+	for _, line := range m.Lines {
+		size += len(line) + 2
+	}
+
+	m.CommitResult = s.d.Filter(s.Id, "commit")
+	if accepted(m.CommitResult) {
+		s.d.Report(s.Id, "tx-commit", s.MsgId, strconv.Itoa(size))
+	} else {
+		s.d.Report(s.Id, "tx-rollback", s.MsgId)
+	}
+	s.d.Report(s.Id, "tx-reset", s.MsgId)
+	s.MsgId = ""
+	return m
+}
+
+func (s *Session) sendDatalines(lines []string) []string {
+	token := s.d.newId()
+	prefix := strings.Join([]string{"filter", s.d.version, s.d.timestamp(), "smtp-in", "data-line", s.Id, token}, "|")
+	for _, line := range lines {
+		// SMTP dot-stuffing
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		s.d.Send(prefix + "|" + line)
+	}
+	s.d.Send(prefix + "|.")
+
+	var out []string
+	for {
+		r := s.d.Await("filter-dataline", s.Id, token)
+		if r.Line == "." {
+			return out
+		}
+		out = append(out, strings.TrimPrefix(r.Line, "."))
+	}
+}
+
+/*
+ * Sends RSET and ends the open transaction.
+ */
+func (s *Session) Rset() Response {
+	s.d.t.Helper()
+	res := s.d.Filter(s.Id, "rset")
+	if s.MsgId != "" {
+		s.d.Report(s.Id, "tx-rollback", s.MsgId)
+		s.d.Report(s.Id, "tx-reset", s.MsgId)
+		s.MsgId = ""
+	}
+	return res
+}
+
+/*
+ * Sends QUIT and closes the session.
+ */
+func (s *Session) Quit() Response {
+	s.d.t.Helper()
+	res := s.d.Filter(s.Id, "quit")
+	s.Disconnect()
+	return res
+}
+
+/*
+ * Closes the session without QUIT, like a client dropping the connection.
+ */
+func (s *Session) Disconnect() {
+	s.d.t.Helper()
+	if s.MsgId != "" {
+		s.d.Report(s.Id, "tx-rollback", s.MsgId)
+		s.d.Report(s.Id, "tx-reset", s.MsgId)
+		s.MsgId = ""
+	}
+	s.d.Report(s.Id, "link-disconnect")
+}
@@ -0,0 +1,98 @@
+package opensmtpd
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * How the parameters of an event are laid out on a protocol line, from the
+ * eventTable generated from events.json.
+ */
+type eventLayout struct {
+	// number of parameters after the session id and token
+	params int
+	// the last parameter may contain "|"
+	text bool
+	// number of parameters at the end that may be missing
+	optional int
+	// protocol versions before legacy use a different order with
+	// legacyParams parameters, in which "|" can't be told apart
+	legacy       string
+	legacyParams int
+}
+
+var eventLayouts = func() map[string]map[string]eventLayout {
+	layouts := make(map[string]map[string]eventLayout)
+	for _, entry := range eventTable {
+		if layouts[entry.typ] == nil {
+			layouts[entry.typ] = make(map[string]eventLayout)
+		}
+		layouts[entry.typ][entry.name] = entry.layout
+	}
+	return layouts
+}()
+
+/*
+ * The atoms of most lines fit into an array allocated together with the
+ * event.
+ */
+const inlineAtoms = 12
+
+type lineEvent struct {
+	FilterEventImpl
+	storage [inlineAtoms]string
+}
+
+/*
+ * Splits a protocol line into atoms, appending them to atoms. The atoms are
+ * substrings of line, nothing is copied. If the last parameter of the event
+ * may contain "|", like the line of a data-line event, it is left intact.
+ * Events of unknown types are split at every "|".
+ */
+func splitLine(line string, atoms []string) ([]string, error) {
+	field, rest, more := "", line, true
+
+	// type|version|timestamp|subsystem|event|session
+	for len(atoms) < 6 && more {
+		field, rest, more = strings.Cut(rest, "|")
+		atoms = append(atoms, field)
+	}
+	if len(atoms) < 6 {
+		return nil, &ProtocolError{Line: line, Reason: "less than 6 atoms"}
+	}
+	header := 6
+	if atoms[0] == "filter" {
+		if !more {
+			return nil, &ProtocolError{Line: line, Reason: "filter event without token"}
+		}
+		field, rest, more = strings.Cut(rest, "|")
+		atoms = append(atoms, field)
+		header = 7
+	}
+
+	layout, known := eventLayouts[atoms[0]][atoms[4]]
+	legacy := known && layout.legacy != "" && compareVersions(atoms[1], layout.legacy) < 0
+	for more {
+		if known && layout.text && !legacy && len(atoms)-header == layout.params-1 {
+			atoms = append(atoms, rest)
+			break
+		}
+		field, rest, more = strings.Cut(rest, "|")
+		atoms = append(atoms, field)
+	}
+
+	if known {
+		min := layout.params - layout.optional
+		if legacy {
+			min = layout.legacyParams
+		}
+		if n := len(atoms) - header; n < min {
+			return nil, &ProtocolError{
+				Line:   line,
+				Reason: fmt.Sprintf("%s: expected at least %d parameters, got %d", atoms[4], min, n),
+			}
+		}
+	}
+	return atoms, nil
+}
@@ -0,0 +1,96 @@
+package opensmtpd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		atoms []string
+	}{
+		{
+			name:  "data-line keeps pipes",
+			line:  "filter|0.7|1.5|smtp-in|data-line|s1|t1|a|b||c",
+			atoms: []string{"filter", "0.7", "1.5", "smtp-in", "data-line", "s1", "t1", "a|b||c"},
+		},
+		{
+			name:  "empty data-line",
+			line:  "filter|0.7|1.5|smtp-in|data-line|s1|t1|",
+			atoms: []string{"filter", "0.7", "1.5", "smtp-in", "data-line", "s1", "t1", ""},
+		},
+		{
+			name:  "report text",
+			line:  "report|0.7|1.5|smtp-in|protocol-client|s1|MAIL FROM:<a|b@example.org>",
+			atoms: []string{"report", "0.7", "1.5", "smtp-in", "protocol-client", "s1", "MAIL FROM:<a|b@example.org>"},
+		},
+		{
+			name:  "text after other parameters",
+			line:  "report|0.7|1.5|smtp-in|tx-mail|s1|m1|ok|<a|b@example.org>",
+			atoms: []string{"report", "0.7", "1.5", "smtp-in", "tx-mail", "s1", "m1", "ok", "<a|b@example.org>"},
+		},
+		{
+			name:  "legacy order is split",
+			line:  "report|0.5|1.5|smtp-in|tx-mail|s1|m1|<a@example.org>|ok",
+			atoms: []string{"report", "0.5", "1.5", "smtp-in", "tx-mail", "s1", "m1", "<a@example.org>", "ok"},
+		},
+		{
+			name:  "missing optional parameter",
+			line:  "report|0.7|1.5|smtp-in|filter-response|s1|rcpt-to|proceed",
+			atoms: []string{"report", "0.7", "1.5", "smtp-in", "filter-response", "s1", "rcpt-to", "proceed"},
+		},
+		{
+			name:  "unknown events are split everywhere",
+			line:  "report|0.8|1.5|smtp-in|link-new|s1|a|b|c",
+			atoms: []string{"report", "0.8", "1.5", "smtp-in", "link-new", "s1", "a", "b", "c"},
+		},
+		{
+			name:  "more atoms than fit inline",
+			line:  "report|0.8|1.5|smtp-in|link-new|s1|1|2|3|4|5|6|7|8",
+			atoms: []string{"report", "0.8", "1.5", "smtp-in", "link-new", "s1", "1", "2", "3", "4", "5", "6", "7", "8"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atoms, err := splitLine(tt.line, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(atoms, tt.atoms) {
+				t.Errorf("got %q, want %q", atoms, tt.atoms)
+			}
+		})
+	}
+}
+
+func TestSplitLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"report|0.7|1.5|smtp-in|link-connect",
+		"filter|0.7|1.5|smtp-in|helo|s1",
+		"report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass",
+		"filter|0.7|1.5|smtp-in|connect|s1|t1|rdns",
+	} {
+		_, err := splitLine(line, nil)
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			t.Errorf("%q: expected a *ProtocolError, got %v", line, err)
+		}
+	}
+}
+
+func TestSplitLineDoesNotAllocate(t *testing.T) {
+	line := "filter|0.7|1.5|smtp-in|data-line|s1|t1|some|text"
+	var storage [inlineAtoms]string
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := splitLine(line, storage[:0]); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("splitLine allocated %v times", allocs)
+	}
+}
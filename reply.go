@@ -0,0 +1,75 @@
+package opensmtpd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var enhancedStatusCode = regexp.MustCompile(`^([245])\.[0-9]{1,3}\.[0-9]{1,3}$`)
+
+/*
+ * An SMTP reply with a 4xx or 5xx code, an optional RFC 3463 enhanced
+ * status code and at most one line of text, as the filter protocol has no
+ * way to express multiline replies. Build it with NewReply so it is
+ * validated.
+ */
+type Reply struct {
+	Code     int
+	Enhanced string
+	Lines    []string
+}
+
+/*
+ * Returns a validated reply. enhanced may be empty, otherwise its class must
+ * match the class of code, like 5.7.1 for 550.
+ */
+func NewReply(code int, enhanced string, lines ...string) (Reply, error) {
+	r := Reply{
+		Code:     code,
+		Enhanced: enhanced,
+		Lines:    lines,
+	}
+	return r, r.validate()
+}
+
+func (r Reply) validate() error {
+	if r.Code < 400 || r.Code > 599 {
+		return fmt.Errorf("opensmtpd: invalid reply code %d, must be 4xx or 5xx", r.Code)
+	}
+	if r.Enhanced != "" {
+		m := enhancedStatusCode.FindStringSubmatch(r.Enhanced)
+		if m == nil {
+			return fmt.Errorf("opensmtpd: invalid enhanced status code %q", r.Enhanced)
+		}
+		if m[1] != strconv.Itoa(r.Code/100) {
+			return fmt.Errorf("opensmtpd: enhanced status code %s doesn't match reply code %d",
+				r.Enhanced, r.Code)
+		}
+	}
+	if len(r.Lines) > 1 {
+		return fmt.Errorf("opensmtpd: reply has %d lines, the filter protocol only carries one", len(r.Lines))
+	}
+	for _, line := range r.Lines {
+		if strings.ContainsAny(line, "\r\n") {
+			return fmt.Errorf("opensmtpd: reply line %q contains a line break", line)
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the reply as sent to an SMTP client and in the filter protocol,
+ * like "550 5.7.1 Relaying denied".
+ */
+func (r Reply) String() string {
+	s := strconv.Itoa(r.Code)
+	if r.Enhanced != "" {
+		s += " " + r.Enhanced
+	}
+	if len(r.Lines) > 0 && r.Lines[0] != "" {
+		s += " " + r.Lines[0]
+	}
+	return s
+}
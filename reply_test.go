@@ -0,0 +1,71 @@
+package opensmtpd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewReply(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     int
+		enhanced string
+		lines    []string
+		want     string
+		err      string
+	}{
+		{"plain", 550, "", []string{"no"}, "550 no", ""},
+		{"enhanced", 550, "5.7.1", []string{"Relaying denied"}, "550 5.7.1 Relaying denied", ""},
+		{"temporary", 451, "4.3.0", []string{"later"}, "451 4.3.0 later", ""},
+		{"code only", 421, "", nil, "421", ""},
+		{"long enhanced", 554, "5.123.456", []string{"x"}, "554 5.123.456 x", ""},
+		{"success code", 250, "", []string{"ok"}, "", "invalid reply code"},
+		{"below range", 399, "", nil, "", "invalid reply code"},
+		{"above range", 600, "", nil, "", "invalid reply code"},
+		{"malformed enhanced", 550, "5.7", nil, "", "invalid enhanced status code"},
+		{"enhanced too long", 550, "5.1234.1", nil, "", "invalid enhanced status code"},
+		{"enhanced class 2", 550, "2.0.0", nil, "", "doesn't match"},
+		{"class mismatch", 450, "5.7.1", nil, "", "doesn't match"},
+		{"LF", 550, "", []string{"no\nfilter-result|s1|t9|proceed"}, "", "line break"},
+		{"CR", 550, "", []string{"no\r"}, "", "line break"},
+		{"multiline", 550, "", []string{"first", "second"}, "", "2 lines"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReply(tt.code, tt.enhanced, tt.lines...)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectValidatesReply(t *testing.T) {
+	out := &linePrinter{}
+	r := event(out, rcptLine).Responder()
+	if err := r.Reject(Reply{Code: 550, Lines: []string{"first", "second"}}); err == nil {
+		t.Error("a multiline reply was sent")
+	}
+	if err := r.HardRejectReply(Reply{Code: 450, Lines: []string{"later"}}); err == nil {
+		t.Error("HardRejectReply accepted a 4xx reply")
+	}
+	if lines := out.Lines(); len(lines) != 0 {
+		t.Errorf("unexpected output %q", lines)
+	}
+
+	if err := r.Reject(Reply{Code: 550, Enhanced: "5.7.1", Lines: []string{"denied"}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "filter-result|s1|t1|reject|550 5.7.1 denied"; strings.Join(out.Lines(), "\n") != want {
+		t.Errorf("got %q, want %q", out.Lines(), want)
+	}
+}
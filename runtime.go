@@ -0,0 +1,444 @@
+package opensmtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+/*
+ * Anything that can send a line to OpenSMTPD. Implementations must be safe
+ * for concurrent use.
+ */
+type Printer interface {
+	SafePrintln(msg string)
+}
+
+/*
+ * Runs one FilterWrapper on a pair of streams. Usually that's stdin and
+ * stdout as set up by OpenSMTPD, but any io.Reader and io.Writer will do,
+ * so several filters can run in the same process.
+ */
+type Runtime struct {
+	fw            FilterWrapper
+	in            io.Reader
+	out           io.Writer
+	workers       int
+	maxLineLength int
+	onBadLine     func(error)
+
+	deadlines       map[string]deadline
+	defaultDeadline *deadline
+
+	config *Config
+}
+
+/*
+ * Configures optional Runtime behaviour.
+ */
+type RuntimeOption func(*Runtime)
+
+/*
+ * Runs handlers on up to n goroutines. Events of different sessions are
+ * handled in parallel, events of the same session are still handled one
+ * after the other in the order OpenSMTPD sent them. Without this option
+ * every event is handled on the goroutine that reads the input.
+ */
+func WithWorkers(n int) RuntimeOption {
+	return func(rt *Runtime) {
+		rt.workers = n
+	}
+}
+
+/*
+ * The longest line a Runtime reads unless WithMaxLineLength is given.
+ */
+const DefaultMaxLineLength = 64 * 1024
+
+/*
+ * Reads lines of up to n bytes. Longer lines are cut off at n bytes instead
+ * of stopping the filter: a data-line is dispatched with a
+ * *LineTooLongError as FilterEvent.GetError(), so the message can be
+ * rejected at commit (SessionTrackingMixin does that), other filter events
+ * are rejected and reports are dropped. n doesn't include the line break.
+ * Panics if n isn't positive.
+ */
+func WithMaxLineLength(n int) RuntimeOption {
+	if n <= 0 {
+		panic(fmt.Sprintf("opensmtpd: invalid maximum line length %d", n))
+	}
+	return func(rt *Runtime) {
+		rt.maxLineLength = n
+	}
+}
+
+/*
+ * Calls fn with a *ProtocolError or *LineTooLongError for every line that
+ * can't be parsed or was cut off, instead of logging it. The line is still
+ * handled as described for Run. fn is called on the goroutine that reads
+ * the input, so it should return quickly.
+ */
+func WithErrorHandler(fn func(error)) RuntimeOption {
+	return func(rt *Runtime) {
+		rt.onBadLine = fn
+	}
+}
+
+func NewRuntime(fw FilterWrapper, in io.Reader, out io.Writer, opts ...RuntimeOption) *Runtime {
+	rt := &Runtime{
+		fw:            fw,
+		in:            in,
+		out:           out,
+		maxLineLength: DefaultMaxLineLength,
+	}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	return rt
+}
+
+/*
+ * Processes the config handshake, registers the filter and dispatches
+ * events until ctx is cancelled, the input is closed or an error occurs.
+ * It waits for running handlers to return and flushes all pending
+ * output before returning. The returned error is never nil:
+ * ErrInputClosed when the input was closed, ctx.Err() on cancellation, a
+ * *HandlerError if a handler panicked or the first error writing the
+ * output, which stops the Runtime right away. Lines that can't be parsed don't
+ * stop the Runtime, so it never returns a *ProtocolError: they are logged
+ * or passed to the WithErrorHandler function, filter events are rejected
+ * and reports dropped. A Runtime can only be run once.
+ */
+func (rt *Runtime) Run(ctx context.Context) (err error) {
+	out := newLineWriter(rt.out)
+	defer func() {
+		if werr := out.Close(); werr != nil && (errors.Is(err, ErrInputClosed) || errors.Is(err, errOutputFailed)) {
+			err = fmt.Errorf("opensmtpd: writing output: %w", werr)
+		}
+	}()
+
+	// stops the reader goroutine once we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	splitter := &lineSplitter{max: rt.maxLineLength}
+	scanner := bufio.NewScanner(rt.in)
+	// room for the line and its "\r\n"; the maximum is the larger of the
+	// buffer's capacity and max
+	bufferSize := rt.maxLineLength + 2
+	scanner.Buffer(make([]byte, 0, min(4096, bufferSize)), bufferSize)
+	scanner.Split(splitter.split)
+
+	configured := make(chan error, 1)
+	go func() {
+		configured <- rt.fw.ProcessConfig(scanner)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-configured:
+		if err != nil {
+			return err
+		}
+	}
+	rt.config = rt.fw.GetConfig()
+	if rt.config == nil {
+		rt.config = NewConfig()
+	}
+	rt.fw.Register(NewEventResponder(NewFilterEvent(out, []string{})))
+
+	lines := make(chan scannedLine)
+	scanErr := make(chan error, 1)
+	go scanLines(ctx, scanner, splitter, lines, scanErr)
+
+	var pool *sessionDispatcher
+	var poolErr <-chan error
+	if rt.workers > 0 {
+		pool = newSessionDispatcher(rt.fw, rt.workers)
+		poolErr = pool.errc
+		// let running handlers finish before the output is closed
+		defer pool.stop()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-out.failed:
+			// smtpd won't get our answers anymore
+			return errOutputFailed
+		case err := <-poolErr:
+			return err
+		case line, ok := <-lines:
+			if !ok {
+				err := <-scanErr
+				if pool != nil && errors.Is(err, ErrInputClosed) {
+					// handle everything that was read before the input closed
+					if perr := pool.wait(); perr != nil {
+						return perr
+					}
+				}
+				return err
+			}
+
+			var event FilterEvent
+			if line.truncated {
+				event = rt.badLine(out, line.text, &LineTooLongError{Max: rt.maxLineLength}, lineTooLongReply)
+			} else if ev, err := rt.newEvent(out, line.text); err != nil {
+				event = rt.badLine(out, line.text, err, protocolErrorReply)
+			} else {
+				event = ev
+			}
+			if event == nil {
+				continue
+			}
+			if pool != nil {
+				if err := pool.submit(ctx, event); err != nil {
+					return err
+				}
+			} else if err := dispatch(rt.fw, event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replaced with the write error once the output is closed
+var errOutputFailed = errors.New("opensmtpd: output failed")
+
+func (rt *Runtime) newEvent(out Printer, line string) (*FilterEventImpl, error) {
+	le := &lineEvent{}
+	atoms, err := splitLine(line, le.storage[:0])
+	if err != nil {
+		return nil, err
+	}
+
+	event := &le.FilterEventImpl
+	event.FilterEventData = FilterEventData{
+		atoms:  atoms,
+		out:    out,
+		config: rt.config,
+	}
+	// data-lines are answered with filter-dataline, not filter-result
+	if atoms[0] == "filter" && atoms[4] != "data-line" {
+		event.pending = newPendingResponse(out, atoms, rt.deadlineFor(atoms[4]))
+		event.out = event.pending
+	}
+	return event, nil
+}
+
+var lineTooLongReply = Reply{
+	Code:     500,
+	Enhanced: "5.5.2",
+	Lines:    []string{"Line too long"},
+}
+
+var protocolErrorReply = Reply{
+	Code:     451,
+	Enhanced: "4.5.0",
+	Lines:    []string{"Filter protocol error"},
+}
+
+/*
+ * Handles a line that was cut off at the maximum line length or can't be
+ * parsed, so one bad line doesn't stop the filter. A data-line is
+ * dispatched with lineErr as FilterEvent.GetError(), so the message can be
+ * rejected at commit. Other filter events are rejected with reply, reports
+ * and lines without a session are dropped. Returns the event to dispatch,
+ * or nil if the line has been dealt with.
+ */
+func (rt *Runtime) badLine(out Printer, line string, lineErr error, reply Reply) FilterEvent {
+	if rt.onBadLine != nil {
+		rt.onBadLine(lineErr)
+	}
+	atoms := strings.SplitN(line, "|", 8)
+	if len(atoms) < 6 || (atoms[0] == "filter" && len(atoms) < 7) {
+		rt.logBadLine("dropping line: %v", lineErr)
+		return nil
+	}
+
+	switch {
+	case atoms[0] == "filter" && atoms[4] == "data-line":
+		if len(atoms) == 7 {
+			// without the line itself
+			line += "|"
+		}
+		event, err := rt.newEvent(out, line)
+		if err != nil {
+			rt.logBadLine("dropping data-line of session %s: %v", atoms[5], err)
+			return nil
+		}
+		event.err = lineErr
+		return event
+	case atoms[0] == "filter":
+		rt.logBadLine("rejecting %s of session %s: %v", atoms[4], atoms[5], lineErr)
+		_ = NewEventResponder(NewFilterEvent(out, atoms[:7])).Reject(reply)
+	default:
+		rt.logBadLine("dropping %s|%s of session %s: %v", atoms[0], atoms[4], atoms[5], lineErr)
+	}
+	return nil
+}
+
+func (rt *Runtime) logBadLine(format string, v ...interface{}) {
+	if rt.onBadLine == nil {
+		log.Printf(format, v...)
+	}
+}
+
+/*
+ * A line read by scanLines. Truncated lines were longer than the maximum
+ * line length.
+ */
+type scannedLine struct {
+	text      string
+	truncated bool
+}
+
+func scanLines(ctx context.Context, scanner *bufio.Scanner, splitter *lineSplitter, lines chan<- scannedLine, errc chan<- error) {
+	defer close(lines)
+	for scanner.Scan() {
+		select {
+		case lines <- scannedLine{scanner.Text(), splitter.truncated}:
+		case <-ctx.Done():
+			errc <- ctx.Err()
+			return
+		}
+	}
+	errc <- scanError(scanner)
+}
+
+func scanError(scanner *bufio.Scanner) error {
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("opensmtpd: reading input: %w", err)
+	}
+	return ErrInputClosed
+}
+
+/*
+ * A bufio.SplitFunc like bufio.ScanLines that cuts off lines at max bytes
+ * and skips the rest of them instead of failing.
+ */
+type lineSplitter struct {
+	max int
+	// the last token was cut off
+	truncated bool
+	// skipping the rest of a line that was cut off
+	skipping bool
+}
+
+func (ls *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	i := bytes.IndexByte(data, '\n')
+	if ls.skipping {
+		if i >= 0 {
+			ls.skipping = false
+			return i + 1, nil, nil
+		}
+		return len(data), nil, nil
+	}
+
+	ls.truncated = false
+	switch {
+	case i >= 0:
+		return i + 1, ls.cut(data[:i]), nil
+	case len(data) >= ls.max+2:
+		// too long even if the line break follows
+		ls.truncated = true
+		ls.skipping = true
+		return ls.max, data[:ls.max], nil
+	case atEOF && len(data) > 0:
+		return len(data), ls.cut(data), nil
+	}
+	return 0, nil, nil
+}
+
+/*
+ * Strips the "\r" of a line and cuts it off at max bytes.
+ */
+func (ls *lineSplitter) cut(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > ls.max {
+		ls.truncated = true
+		line = line[:ls.max]
+	}
+	return line
+}
+
+func dispatch(fw FilterWrapper, ev FilterEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &HandlerError{
+				Event: ev,
+				Value: r,
+			}
+		}
+	}()
+
+	fw.Dispatch(ev)
+	return nil
+}
+
+/*
+ * Serializes all output of a Runtime through a single goroutine so
+ * handlers can respond from any goroutine.
+ */
+type lineWriter struct {
+	w      io.Writer
+	lines  chan string
+	done   chan struct{}
+	exited chan struct{}
+	// closed once a write failed; err is set before
+	failed chan struct{}
+	err    error
+}
+
+func newLineWriter(w io.Writer) *lineWriter {
+	lw := &lineWriter{
+		w:      w,
+		lines:  make(chan string),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+		failed: make(chan struct{}),
+	}
+	go lw.run()
+	return lw
+}
+
+func (lw *lineWriter) run() {
+	defer close(lw.exited)
+	for {
+		select {
+		case str := <-lw.lines:
+			if lw.err != nil {
+				continue
+			}
+			if _, lw.err = io.WriteString(lw.w, str); lw.err != nil {
+				close(lw.failed)
+			}
+		case <-lw.done:
+			return
+		}
+	}
+}
+
+/*
+ * Lines are handed over synchronously, so every line for which SafePrintln
+ * has returned is written before Close returns. Lines sent after Close are
+ * dropped.
+ */
+func (lw *lineWriter) SafePrintln(msg string) {
+	select {
+	case lw.lines <- msg + "\n":
+	case <-lw.done:
+	}
+}
+
+func (lw *lineWriter) Close() error {
+	close(lw.done)
+	<-lw.exited
+	return lw.err
+}
@@ -0,0 +1,269 @@
+package opensmtpd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Runs fw on input, which is prefixed with the end of the config
+ * handshake, and returns the lines it wrote after registering.
+ */
+func runInput(t *testing.T, fw FilterWrapper, input string, opts ...RuntimeOption) ([]string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := NewRuntime(fw, strings.NewReader("config|ready\n"+input), &out, opts...).Run(context.Background())
+
+	var lines []string
+	registered := false
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if registered {
+			lines = append(lines, line)
+		}
+		registered = registered || line == "register|ready"
+	}
+	return lines, err
+}
+
+func proceedOn(phase string) FilterWrapper {
+	return NewFilter(nil).OnFilter(phase, func(fw FilterWrapper, ev FilterEvent) {
+		ev.Responder().Proceed()
+	})
+}
+
+func TestRunSurvivesMalformedLines(t *testing.T) {
+	var reports int
+	fw := proceedOn("helo").OnReport("link-connect", func(fw FilterWrapper, ev FilterEvent) {
+		reports++
+	})
+	input := "garbage\n" +
+		"report|0.7|1.5|smtp-in|link-connect|s1|rdns\n" +
+		"filter|0.7|1.5|smtp-in|helo|s1|t1\n" +
+		"filter|0.7|1.5|smtp-in|helo|s1|t2|example.org\n" +
+		"report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25\n"
+
+	lines, err := runInput(t, fw, input)
+	if !errors.Is(err, ErrInputClosed) {
+		t.Fatalf("expected ErrInputClosed, got %v", err)
+	}
+	want := []string{
+		"filter-result|s1|t1|reject|451 4.5.0 Filter protocol error",
+		"filter-result|s1|t2|proceed",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+	if reports != 1 {
+		t.Errorf("expected 1 report, got %d", reports)
+	}
+}
+
+func TestRunDispatchesMalformedDatalineWithError(t *testing.T) {
+	var errs []error
+	fw := NewFilter(nil).OnFilter("data-line", func(fw FilterWrapper, ev FilterEvent) {
+		errs = append(errs, ev.GetError())
+	})
+	if _, err := runInput(t, fw, "filter|0.7|1.5|smtp-in|data-line|s1|t1\n"); !errors.Is(err, ErrInputClosed) {
+		t.Fatal(err)
+	}
+	var perr *ProtocolError
+	if len(errs) != 1 || !errors.As(errs[0], &perr) {
+		t.Errorf("expected one *ProtocolError, got %v", errs)
+	}
+}
+
+func TestRunPassesBadLinesToErrorHandler(t *testing.T) {
+	var errs []error
+	input := "garbage\n" +
+		"filter|0.7|1.5|smtp-in|helo|s1|t1\n" +
+		"filter|0.7|1.5|smtp-in|helo|s1|t2|" + strings.Repeat("x", 100) + "\n"
+	lines, err := runInput(t, proceedOn("helo"), input, WithMaxLineLength(50), WithErrorHandler(func(err error) {
+		errs = append(errs, err)
+	}))
+	if !errors.Is(err, ErrInputClosed) {
+		t.Fatalf("expected ErrInputClosed, got %v", err)
+	}
+	if len(lines) != 2 {
+		t.Errorf("expected both filter events to be rejected, got %q", lines)
+	}
+
+	var perr *ProtocolError
+	var lerr *LineTooLongError
+	if len(errs) != 3 || !errors.As(errs[0], &perr) || !errors.As(errs[1], &perr) || !errors.As(errs[2], &lerr) {
+		t.Errorf("expected two *ProtocolError and a *LineTooLongError, got %v", errs)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	prefix := "filter|0.7|1.5|smtp-in|helo|s1|t1|"
+	exact := prefix + strings.Repeat("x", 100-len(prefix))
+
+	tests := []struct {
+		name string
+		line string
+		verb string
+	}{
+		{"exactly max", exact + "\n", "proceed"},
+		{"exactly max with CRLF", exact + "\r\n", "proceed"},
+		{"exactly max at EOF", exact, "proceed"},
+		{"one byte more", exact + "x\n", "reject|500 5.5.2 Line too long"},
+		{"one byte more with CRLF", exact + "x\r\n", "reject|500 5.5.2 Line too long"},
+		{"one byte more at EOF", exact + "x", "reject|500 5.5.2 Line too long"},
+		{"much longer", exact + strings.Repeat("x", 1000) + "\n", "reject|500 5.5.2 Line too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, err := runInput(t, proceedOn("helo"), tt.line, WithMaxLineLength(100))
+			if !errors.Is(err, ErrInputClosed) {
+				t.Fatalf("expected ErrInputClosed, got %v", err)
+			}
+			if want := "filter-result|s1|t1|" + tt.verb; len(lines) != 1 || lines[0] != want {
+				t.Errorf("got %q, want %q", lines, want)
+			}
+		})
+	}
+}
+
+func TestMaxLineLengthContinuesAfterLongLine(t *testing.T) {
+	var got []string
+	fw := NewFilter(nil).OnFilter("data-line", func(fw FilterWrapper, ev FilterEvent) {
+		dl, err := ev.DatalineRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lerr *LineTooLongError
+		if errors.As(ev.GetError(), &lerr) {
+			got = append(got, "too long")
+			return
+		}
+		got = append(got, dl.Line)
+	})
+	input := "filter|0.7|1.5|smtp-in|data-line|s1|t1|before\n" +
+		"filter|0.7|1.5|smtp-in|data-line|s1|t1|" + strings.Repeat("x", 200) + "\n" +
+		"filter|0.7|1.5|smtp-in|data-line|s1|t1|after\n"
+	if _, err := runInput(t, fw, input, WithMaxLineLength(100)); !errors.Is(err, ErrInputClosed) {
+		t.Fatal(err)
+	}
+	if want := []string{"before", "too long", "after"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWithMaxLineLengthRejectsNonPositive(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("WithMaxLineLength(%d) didn't panic", n)
+				}
+			}()
+			WithMaxLineLength(n)
+		}()
+	}
+}
+
+func TestRunReturnsOnCancel(t *testing.T) {
+	for _, handshake := range []string{"", "config|ready\n"} {
+		r, w := io.Pipe()
+		defer w.Close()
+		go io.WriteString(w, handshake)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- NewRuntime(proceedOn("helo"), r, io.Discard).Run(ctx)
+		}()
+		cancel()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run didn't return after the context was cancelled")
+		}
+	}
+}
+
+func TestRunReturnsHandlerPanics(t *testing.T) {
+	fw := NewFilter(nil).OnFilter("helo", func(fw FilterWrapper, ev FilterEvent) {
+		panic("broken")
+	})
+	input := "filter|0.7|1.5|smtp-in|helo|s1|t1|example.org\n"
+	for _, opts := range [][]RuntimeOption{nil, {WithWorkers(2)}} {
+		_, err := runInput(t, fw, input, opts...)
+		var herr *HandlerError
+		if !errors.As(err, &herr) || herr.Value != "broken" || herr.Event.GetVerb() != "helo" {
+			t.Errorf("expected a *HandlerError, got %v", err)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestRunReturnsWriteErrors(t *testing.T) {
+	err := NewRuntime(proceedOn("helo"), strings.NewReader("config|ready\n"), failingWriter{}).Run(context.Background())
+	if err == nil || errors.Is(err, ErrInputClosed) || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("expected the write error, got %v", err)
+	}
+}
+
+func TestRunStopsOnWriteError(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	go io.WriteString(w, "config|ready\nfilter|0.7|1.5|smtp-in|helo|s1|t1|example.org\n")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- NewRuntime(proceedOn("helo"), r, failingWriter{}).Run(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Errorf("expected the write error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after writing failed")
+	}
+}
+
+func TestRuntimesHaveTheirOwnStreams(t *testing.T) {
+	input := "config|ready\n" +
+		"filter|0.7|1.5|smtp-in|helo|s1|t1|example.org\n" +
+		"filter|0.7|1.5|smtp-in|helo|s2|t2|example.com\n"
+	filters := []FilterWrapper{proceedOn("helo"), rejectOn("helo")}
+	outputs := make([]bytes.Buffer, len(filters))
+	errs := make(chan error, len(filters))
+	for i, fw := range filters {
+		r, w := io.Pipe()
+		go func() {
+			io.WriteString(w, input)
+			w.Close()
+		}()
+		go func(i int, fw FilterWrapper) {
+			errs <- NewRuntime(fw, r, &outputs[i]).Run(context.Background())
+		}(i, fw)
+	}
+	for range filters {
+		if err := <-errs; !errors.Is(err, ErrInputClosed) {
+			t.Fatal(err)
+		}
+	}
+
+	for i, verb := range []string{"proceed", "reject|451 try later"} {
+		want := "register|filter|smtp-in|helo\nregister|ready\n" +
+			"filter-result|s1|t1|" + verb + "\nfilter-result|s2|t2|" + verb + "\n"
+		if got := outputs[i].String(); got != want {
+			t.Errorf("runtime %d wrote %q, want %q", i, got, want)
+		}
+	}
+}
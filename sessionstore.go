@@ -0,0 +1,287 @@
+package opensmtpd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+ * Persists the sessions of a SessionHolderImpl, so a filter that is
+ * restarted by smtpd can continue the sessions that are still connected.
+ * See SessionHolderImpl.SetStore. Message, Body and MessageError aren't
+ * stored.
+ *
+ * Save and Delete are called while the session is locked, so they're never
+ * called concurrently for the same session, but may be for different ones.
+ * Save must not keep the session after it returned.
+ */
+type SessionStore interface {
+	Save(*SMTPSession) error
+	Delete(sessionId string) error
+	Load() (map[string]*SMTPSession, error)
+	Close() error
+}
+
+/*
+ * Keeps copies of the saved sessions in memory. It doesn't survive a
+ * restart, but can stand in for a persistent store in tests.
+ */
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*SMTPSession
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*SMTPSession),
+	}
+}
+
+func (ms *MemorySessionStore) Save(s *SMTPSession) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.sessions[s.Id] = storedCopy(s)
+	return nil
+}
+
+func (ms *MemorySessionStore) Delete(sessionId string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.sessions, sessionId)
+	return nil
+}
+
+func (ms *MemorySessionStore) Load() (map[string]*SMTPSession, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	sessions := make(map[string]*SMTPSession, len(ms.sessions))
+	for id, s := range ms.sessions {
+		sessions[id] = s.Clone()
+	}
+	return sessions, nil
+}
+
+func (ms *MemorySessionStore) Close() error {
+	return nil
+}
+
+/*
+ * Returns a copy of s without the fields that aren't stored, so a loaded
+ * session shares no message buffer, stream or lock with the live one.
+ */
+func storedCopy(s *SMTPSession) *SMTPSession {
+	c := *s
+	c.RcptTo = append([]string(nil), s.RcptTo...)
+	c.Message = nil
+	c.Body = nil
+	c.MessageError = nil
+	c.stream = nil
+	c.parsed = nil
+	c.lock = nil
+	c.deleted = false
+	return &c
+}
+
+/*
+ * Stores sessions in a file as an append-only log of JSON records, one per
+ * line. The log is compacted when it has grown to more than twice the
+ * records needed for the current sessions, and when the store is opened.
+ *
+ * Records are written without fsync: they survive a crash of the filter,
+ * which is what the store is for, but not necessarily one of the system.
+ */
+type FileSessionStore struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	sessions map[string]*SMTPSession
+	// records in the log
+	records int
+}
+
+// the log is compacted only if it has at least this many records
+const minCompactRecords = 1024
+
+type storeRecord struct {
+	Op      string       `json:"op"`
+	Id      string       `json:"id,omitempty"`
+	Session *SMTPSession `json:"session,omitempty"`
+}
+
+/*
+ * Opens the log at path, creating it if it doesn't exist, and reads the
+ * sessions stored in it. A partly written last record, as left by a crash,
+ * is ignored.
+ */
+func OpenFileSessionStore(path string) (*FileSessionStore, error) {
+	fs := &FileSessionStore{
+		path:     path,
+		sessions: make(map[string]*SMTPSession),
+	}
+	if err := fs.read(); err != nil {
+		return nil, err
+	}
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileSessionStore) read() error {
+	f, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opensmtpd: opening session store: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// only the last record can be incomplete
+			continue
+		}
+		switch {
+		case rec.Op == "save" && rec.Session != nil:
+			fs.sessions[rec.Session.Id] = rec.Session
+		case rec.Op == "delete":
+			delete(fs.sessions, rec.Id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("opensmtpd: reading session store: %w", err)
+	}
+	return nil
+}
+
+func (fs *FileSessionStore) Save(s *SMTPSession) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	stored := storedCopy(s)
+	if err := fs.append(storeRecord{Op: "save", Session: stored}); err != nil {
+		return err
+	}
+	fs.sessions[s.Id] = stored
+	return fs.maybeCompact()
+}
+
+func (fs *FileSessionStore) Delete(sessionId string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.sessions[sessionId]; !ok {
+		return nil
+	}
+	if err := fs.append(storeRecord{Op: "delete", Id: sessionId}); err != nil {
+		return err
+	}
+	delete(fs.sessions, sessionId)
+	return fs.maybeCompact()
+}
+
+/*
+ * Returns the stored sessions.
+ */
+func (fs *FileSessionStore) Load() (map[string]*SMTPSession, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	sessions := make(map[string]*SMTPSession, len(fs.sessions))
+	for id, s := range fs.sessions {
+		sessions[id] = s.Clone()
+	}
+	return sessions, nil
+}
+
+func (fs *FileSessionStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.f == nil {
+		return nil
+	}
+	err := fs.f.Close()
+	fs.f = nil
+	return err
+}
+
+func (fs *FileSessionStore) append(rec storeRecord) error {
+	if fs.f == nil {
+		return fmt.Errorf("opensmtpd: session store is closed")
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("opensmtpd: encoding session: %w", err)
+	}
+	if _, err := fs.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("opensmtpd: writing session store: %w", err)
+	}
+	fs.records++
+	return nil
+}
+
+func (fs *FileSessionStore) maybeCompact() error {
+	if fs.records < minCompactRecords || fs.records <= 2*len(fs.sessions) {
+		return nil
+	}
+	return fs.compact()
+}
+
+/*
+ * Replaces the log with one that only saves the current sessions. The new
+ * log is written next to the old one and renamed over it, so a crash leaves
+ * one of them intact.
+ */
+func (fs *FileSessionStore) compact() error {
+	tmp := fs.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("opensmtpd: compacting session store: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, s := range fs.sessions {
+		if err = enc.Encode(storeRecord{Op: "save", Session: s}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fs.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("opensmtpd: compacting session store: %w", err)
+	}
+
+	if fs.f != nil {
+		fs.f.Close()
+		fs.f = nil
+	}
+	fs.f, err = os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opensmtpd: opening session store: %w", err)
+	}
+	fs.records = len(fs.sessions)
+	return nil
+}
@@ -0,0 +1,55 @@
+package opensmtpd
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLoadedSessionSharesNothingWithLive(t *testing.T) {
+	file, err := OpenFileSessionStore(filepath.Join(t.TempDir(), "sessions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	stores := map[string]SessionStore{"memory": NewMemorySessionStore(), "file": file}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			live := &SMTPSession{
+				Id:     "s1",
+				RcptTo: []string{"rcpt@example.org"},
+				Body:   newMessageBuffer(&MessageLimits{}),
+				lock:   &sync.Mutex{},
+			}
+			defer live.Body.Close()
+			if err := live.Body.Append("Subject: live"); err != nil {
+				t.Fatal(err)
+			}
+			live.Message = []string{"Subject: live"}
+			live.parsed = parseMessage(live.Message)
+			live.stream = &messageStream{}
+
+			if err := store.Save(live); err != nil {
+				t.Fatal(err)
+			}
+			live.RcptTo[0] = "changed@example.org"
+
+			sessions, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded := sessions["s1"]
+			if loaded == nil {
+				t.Fatal("the session wasn't loaded")
+			}
+			if loaded.Body != nil || loaded.Message != nil || loaded.parsed != nil ||
+				loaded.stream != nil || loaded.lock != nil {
+				t.Errorf("the loaded session shares state with the live one: %+v", loaded)
+			}
+			if loaded.RcptTo[0] != "rcpt@example.org" {
+				t.Errorf("the loaded session shares RcptTo with the live one: %q", loaded.RcptTo)
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package opensmtpd
 
 import (
+	"errors"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type SMTPSession struct {
-	Id string
+	Id        string
+	Subsystem string
 
 	Rdns     string
 	Src      string
@@ -19,24 +24,238 @@ type SMTPSession struct {
 	Msgid    string
 	MailFrom string
 	RcptTo   []string
-	Message  []string
+	// the lines of the message while Body keeps them in memory, nil once
+	// they were spilled to a file; MessageLines returns them in both cases
+	Message []string `json:"-"`
+	// the message, also when it was spilled to a file; see MessageLimits
+	Body *MessageBuffer `json:"-"`
+	// why the current message will be rejected at commit, like a
+	// *LineTooLongError
+	MessageError error `json:"-"`
+	// the message being handed to a MessageStreamHandler
+	stream *messageStream
+	// the message parsed by ParsedMessage
+	parsed *MIMEPart
+	// held while the session is changed or saved; see SessionHolderImpl
+	lock *sync.Mutex
+	// set once the session was deleted from its holder
+	deleted bool
+
+	// timestamps of the events as reported by smtpd
+	ConnectedAt     time.Time
+	FirstMailFromAt time.Time
+	DataStartedAt   time.Time
+	DataEndedAt     time.Time
+	// the timestamp of the last event SessionTrackingMixin handled
+	UpdatedAt time.Time
+}
+
+/*
+ * Returns the time between the connection and the first accepted MAIL FROM,
+ * or 0 if there was none yet.
+ */
+func (s *SMTPSession) TimeToMailFrom() time.Duration {
+	if s.FirstMailFromAt.IsZero() {
+		return 0
+	}
+	return s.FirstMailFromAt.Sub(s.ConnectedAt)
+}
+
+/*
+ * Returns the time it took the client to send the message of the current
+ * or last transaction, or 0 if the message is incomplete.
+ */
+func (s *SMTPSession) DataDuration() time.Duration {
+	if s.DataStartedAt.IsZero() || s.DataEndedAt.IsZero() {
+		return 0
+	}
+	return s.DataEndedAt.Sub(s.DataStartedAt)
+}
+
+/*
+ * Returns how long the session has been connected at the time of ev.
+ */
+func (s *SMTPSession) ConnectedFor(ev FilterEvent) time.Duration {
+	return ev.GetTimestamp().Sub(s.ConnectedAt)
+}
+
+/*
+ * Returns a deep copy of the session that shares no memory with s, except
+ * for Body, which is safe for concurrent use. The copy parses its message
+ * again.
+ */
+func (s *SMTPSession) Clone() *SMTPSession {
+	c := *s
+	c.RcptTo = append([]string(nil), s.RcptTo...)
+	c.Message = append([]string(nil), s.Message...)
+	c.parsed = nil
+	c.lock = nil
+	c.deleted = false
+	return &c
+}
+
+/*
+ * Returns the message parsed as MIME. It is parsed on the first call, so
+ * call it once the message is complete, for example in MessageComplete,
+ * and before FlushMessage frees the Body. A spilled message is read back
+ * into memory. FlushMessage writes back the message with the changes made
+ * to it. Not safe for concurrent use.
+ */
+func (s *SMTPSession) ParsedMessage() (*MIMEPart, error) {
+	if s.parsed != nil {
+		return s.parsed, nil
+	}
+
+	lines, err := s.MessageLines()
+	if err != nil {
+		return nil, err
+	}
+	s.parsed = parseMessage(lines)
+	return s.parsed, nil
+}
+
+/*
+ * Returns the lines of the message. Unlike Message, it also works for a
+ * message that was spilled to a file, which is read back into memory.
+ */
+func (s *SMTPSession) MessageLines() ([]string, error) {
+	if s.Body == nil || !s.Body.Spilled() {
+		return s.Message, nil
+	}
+
+	var lines []string
+	err := s.Body.Each(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
 }
 
 type SessionHolder interface {
 	GetSessions() map[string]*SMTPSession
 	GetSession(string) *SMTPSession
 	SetSession(*SMTPSession)
+	DeleteSession(string)
+	UpdateSession(string, func(*SMTPSession)) bool
+	SnapshotSession(string) *SMTPSession
+	SnapshotSessions() map[string]*SMTPSession
 }
 
+/*
+ * Safe for concurrent use. GetSession and GetSessions return the stored
+ * sessions themselves, which other goroutines may be changing; use
+ * UpdateSession to change a session and SnapshotSession or
+ * SnapshotSessions to read one from another goroutine.
+ *
+ * mu only guards the map. Each session has a lock of its own, which is
+ * held while it is changed and saved, so a session that writes its message
+ * to disk or is saved to a slow store doesn't hold up the others.
+ */
 type SessionHolderImpl struct {
+	mu       sync.Mutex
 	Sessions map[string]*SMTPSession
+
+	store SessionStore
+}
+
+/*
+ * Saves every change of a session to store from now on, and adds the
+ * sessions in store that were updated within maxAge to the holder, so a
+ * restarted filter continues the sessions that are still connected. A
+ * message that was being received is rejected at commit with a
+ * *MessageInterruptedError, as its first lines are lost. Older
+ * sessions are deleted from the store; a maxAge of 0 keeps all of them.
+ * smtpd's smtp-session-timeout (Config.SessionTimeout) is a good maxAge.
+ * Call it before the filter runs.
+ */
+func (shi *SessionHolderImpl) SetStore(store SessionStore, maxAge time.Duration) error {
+	sessions, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	shi.mu.Lock()
+	defer shi.mu.Unlock()
+
+	if shi.Sessions == nil {
+		shi.Sessions = make(map[string]*SMTPSession)
+	}
+	for id, s := range sessions {
+		if maxAge > 0 && time.Since(s.UpdatedAt) > maxAge {
+			if err := store.Delete(id); err != nil {
+				return err
+			}
+			continue
+		}
+		if !s.DataStartedAt.IsZero() && s.DataEndedAt.IsZero() {
+			// the lines received before the restart are gone
+			s.MessageError = &MessageInterruptedError{}
+		}
+		shi.Sessions[id] = s
+	}
+	shi.store = store
+	return nil
+}
+
+/*
+ * Saves s to store, if there is one. Errors are logged, the session lives
+ * on in memory. The session's lock must be held.
+ */
+func saveSession(store SessionStore, s *SMTPSession) {
+	if store == nil {
+		return
+	}
+	if err := store.Save(s); err != nil {
+		log.Printf("saving session %s: %v", s.Id, err)
+	}
+}
+
+/*
+ * Returns the session and the store. The session's lock may only be taken
+ * after mu was released.
+ */
+func (shi *SessionHolderImpl) lookup(sessionId string) (*SMTPSession, SessionStore) {
+	shi.mu.Lock()
+	defer shi.mu.Unlock()
+
+	s := shi.Sessions[sessionId]
+	if s != nil {
+		initLock(s)
+	}
+	return s, shi.store
+}
+
+/*
+ * Gives s its lock, which sessions added to Sessions directly don't have
+ * yet. mu must be held.
+ */
+func initLock(s *SMTPSession) {
+	if s.lock == nil {
+		s.lock = &sync.Mutex{}
+	}
 }
 
+/*
+ * Returns a copy of the session map that can be iterated safely.
+ */
 func (shi *SessionHolderImpl) GetSessions() map[string]*SMTPSession {
-	return shi.Sessions
+	shi.mu.Lock()
+	defer shi.mu.Unlock()
+
+	sessions := make(map[string]*SMTPSession, len(shi.Sessions))
+	for id, s := range shi.Sessions {
+		sessions[id] = s
+	}
+	return sessions
 }
 
 func (shi *SessionHolderImpl) GetSession(sessionId string) *SMTPSession {
+	shi.mu.Lock()
+	defer shi.mu.Unlock()
+
 	if shi.Sessions == nil {
 		return nil
 	}
@@ -44,169 +263,519 @@ func (shi *SessionHolderImpl) GetSession(sessionId string) *SMTPSession {
 }
 
 func (shi *SessionHolderImpl) SetSession(session *SMTPSession) {
+	shi.mu.Lock()
 	if shi.Sessions == nil {
 		shi.Sessions = make(map[string]*SMTPSession)
 	}
+	old := shi.Sessions[session.Id]
+	if old != nil && old != session {
+		initLock(old)
+	}
+	initLock(session)
 	shi.Sessions[session.Id] = session
+	store := shi.store
+	shi.mu.Unlock()
+
+	if old != nil && old != session {
+		// changes that are still being made to the replaced session
+		// mustn't be saved over this one
+		old.lock.Lock()
+		old.deleted = true
+		old.lock.Unlock()
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if !session.deleted {
+		saveSession(store, session)
+	}
+}
+
+func (shi *SessionHolderImpl) DeleteSession(sessionId string) {
+	shi.mu.Lock()
+	s := shi.Sessions[sessionId]
+	if s != nil {
+		initLock(s)
+	}
+	delete(shi.Sessions, sessionId)
+	store := shi.store
+	shi.mu.Unlock()
+
+	if s != nil {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.deleted = true
+	}
+	if store != nil {
+		if err := store.Delete(sessionId); err != nil {
+			log.Printf("deleting session %s: %v", sessionId, err)
+		}
+	}
+}
+
+/*
+ * Calls fn with the session while no other goroutine can read or change
+ * the session through the holder. Returns false without calling fn if
+ * there is no such session. fn must not call methods of the holder.
+ */
+func (shi *SessionHolderImpl) UpdateSession(sessionId string, fn func(*SMTPSession)) bool {
+	return shi.updateSession(sessionId, fn, true)
+}
+
+/*
+ * Like UpdateSession. Changes that only affect fields which aren't stored,
+ * like the message, don't need to be saved.
+ */
+func (shi *SessionHolderImpl) updateSession(sessionId string, fn func(*SMTPSession), save bool) bool {
+	s, store := shi.lookup(sessionId)
+	if s == nil {
+		return false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.deleted {
+		return false
+	}
+	fn(s)
+	if save {
+		saveSession(store, s)
+	}
+	return true
+}
+
+/*
+ * Returns a deep copy of the session, or nil if there is no such session.
+ */
+func (shi *SessionHolderImpl) SnapshotSession(sessionId string) *SMTPSession {
+	s, _ := shi.lookup(sessionId)
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.deleted {
+		return nil
+	}
+	return s.Clone()
+}
+
+/*
+ * Returns deep copies of all sessions.
+ */
+func (shi *SessionHolderImpl) SnapshotSessions() map[string]*SMTPSession {
+	shi.mu.Lock()
+	sessions := make(map[string]*SMTPSession, len(shi.Sessions))
+	for id, s := range shi.Sessions {
+		initLock(s)
+		sessions[id] = s
+	}
+	shi.mu.Unlock()
+
+	for id, s := range sessions {
+		s.lock.Lock()
+		if s.deleted {
+			delete(sessions, id)
+		} else {
+			sessions[id] = s.Clone()
+		}
+		s.lock.Unlock()
+	}
+	return sessions
+}
+
+/*
+ * Logs an event the mixin can't parse.
+ */
+func skipEvent(ev FilterEvent, err error) {
+	log.Printf("skipping %s|%s of session %s: %v", ev.GetType(), ev.GetVerb(), ev.GetSessionId(), err)
 }
 
 type SessionTrackingMixin struct {
 	SessionHolderImpl
+
+	limits *MessageLimits
+}
+
+/*
+ * Limits the memory the collected messages use and the size of a message.
+ * Call it before the filter runs.
+ */
+func (sf *SessionTrackingMixin) SetMessageLimits(limits *MessageLimits) {
+	sf.limits = limits
 }
 
+/*
+ * The handlers below log and skip events that can't be parsed; a data-line
+ * that can't be parsed gets the message rejected at commit.
+ */
 func (sf *SessionTrackingMixin) LinkConnect(fw FilterWrapper, ev FilterEvent) {
-	if len(ev.GetParams()) != 4 {
-		log.Fatal("invalid input, shouldn't happen")
+	lc, err := ev.LinkConnect()
+	if err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	params := ev.GetParams()
-
 	s := SMTPSession{}
 	s.Id = ev.GetSessionId()
-	s.Rdns = params[0]
-	s.Src = params[2]
-
-	// parse ipv6 if necessary
-	tmp := strings.Split(s.Src, ":")
-	s.SrcPort = tmp[len(tmp)-1]
-
-	// remove the port (last section)
-	tmp = tmp[0 : len(tmp)-1]
-
-	// reassemble ipv6 address with : separator
-	srcIp := strings.Join(tmp, ":")
-	if strings.HasPrefix(srcIp, "[") {
-		// remove the ipv6 wrapper []
-		srcIp = srcIp[1 : len(srcIp)-1]
+	s.Subsystem = ev.GetSubsystem()
+	s.ConnectedAt = ev.GetTimestamp()
+	s.UpdatedAt = s.ConnectedAt
+	s.Rdns = lc.Rdns
+	if lc.Src.IsValid() {
+		s.Src = lc.Src.String()
+		s.SrcIp = lc.Src.Addr().String()
+		s.SrcPort = strconv.Itoa(int(lc.Src.Port()))
+	} else {
+		// unix socket
+		s.Src = ev.GetParams()[2]
 	}
-	s.SrcIp = srcIp
 
 	sf.SetSession(&s)
 }
 
 func (sf *SessionTrackingMixin) LinkDisconnect(fw FilterWrapper, ev FilterEvent) {
-	if len(ev.GetParams()) != 0 {
-		log.Fatal("invalid input, shouldn't happen")
+	if _, err := ev.LinkDisconnect(); err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	delete(sf.GetSessions(), ev.GetSessionId())
+	sf.updateSession(ev.GetSessionId(), func(s *SMTPSession) {
+		s.Body.Close()
+		if s.stream != nil {
+			s.stream.abort()
+		}
+	}, false)
+	sf.DeleteSession(ev.GetSessionId())
+}
+
+/*
+ * Changes the session of ev and records the time of ev as its UpdatedAt.
+ */
+func (sf *SessionTrackingMixin) update(ev FilterEvent, fn func(*SMTPSession)) {
+	sf.UpdateSession(ev.GetSessionId(), func(s *SMTPSession) {
+		fn(s)
+		s.UpdatedAt = ev.GetTimestamp()
+	})
 }
 
 func (sf *SessionTrackingMixin) LinkGreeting(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) != 1 {
-		log.Fatal("invalid input, shouldn't happen")
+	lg, err := ev.LinkGreeting()
+	if err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	s := sf.GetSession(ev.GetSessionId())
-	s.MtaName = params[0]
-	sf.SetSession(s)
+	sf.update(ev, func(s *SMTPSession) {
+		s.MtaName = lg.Hostname
+	})
 }
 
 func (sf *SessionTrackingMixin) LinkIdentify(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) != 2 {
-		log.Fatal("invalid input, shouldn't happen")
+	li, err := ev.LinkIdentify()
+	if err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	if sh, ok := fw.GetFilter().(SessionHolder); ok {
-		s := sh.GetSession(ev.GetSessionId())
-		s.HeloName = params[1]
-		sh.SetSession(s)
-	}
+	sf.update(ev, func(s *SMTPSession) {
+		s.HeloName = li.Hostname
+	})
 }
 
 func (sf *SessionTrackingMixin) LinkAuth(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) != 2 {
-		log.Fatal("invalid input, shouldn't happen")
+	la, err := ev.LinkAuth()
+	if err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
 	// don't store usernames that didn't successfully authenticate
-	if params[1] != "pass" {
+	if la.Result != "pass" {
 		return
 	}
-	s := sf.GetSession(ev.GetSessionId())
-	s.UserName = params[0]
-	sf.SetSession(s)
+	sf.update(ev, func(s *SMTPSession) {
+		s.UserName = la.Username
+	})
 }
 
 func (sf *SessionTrackingMixin) TxReset(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) != 1 {
-		log.Fatal("invalid input, shouldn't happen")
+	if _, err := ev.TxReset(); err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	s := sf.GetSession(ev.GetSessionId())
-	s.Msgid = ""
-	s.MailFrom = ""
-	s.RcptTo = nil
-	s.Message = nil
-	sf.SetSession(s)
+	sf.update(ev, func(s *SMTPSession) {
+		s.Msgid = ""
+		s.MailFrom = ""
+		s.RcptTo = nil
+		s.Message = nil
+		s.Body.Close()
+		s.Body = nil
+		s.parsed = nil
+		if s.stream != nil {
+			// the message wasn't completed
+			s.stream.abort()
+			s.stream = nil
+		}
+		s.MessageError = nil
+	})
 }
 
 func (sf *SessionTrackingMixin) TxBegin(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) != 1 {
-		log.Fatal("invalid input, shouldn't happen")
+	tb, err := ev.TxBegin()
+	if err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	s := sf.GetSession(ev.GetSessionId())
-	s.Msgid = params[0]
-	sf.SetSession(s)
+	sf.update(ev, func(s *SMTPSession) {
+		s.Msgid = tb.MsgID
+	})
 }
 
 func (sf *SessionTrackingMixin) TxMail(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) != 3 {
-		log.Fatal("invalid input, shouldn't happen")
+	tm, err := ev.TxMail()
+	if err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	if params[2] != "ok" {
+	if tm.Result != "ok" {
 		return
 	}
 
-	s := sf.GetSession(ev.GetSessionId())
-	s.MailFrom = params[1]
-	sf.SetSession(s)
+	sf.update(ev, func(s *SMTPSession) {
+		s.MailFrom = tm.Address
+		if s.FirstMailFromAt.IsZero() {
+			s.FirstMailFromAt = ev.GetTimestamp()
+		}
+	})
 }
 
 func (sf *SessionTrackingMixin) TxRcpt(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) != 3 {
-		log.Fatal("invalid input, shouldn't happen")
+	tr, err := ev.TxRcpt()
+	if err != nil {
+		skipEvent(ev, err)
+		return
 	}
 
-	if params[2] != "ok" {
+	if tr.Result != "ok" {
 		return
 	}
 
-	s := sf.GetSession(ev.GetSessionId())
-	s.RcptTo = append(s.RcptTo, params[1])
-	sf.SetSession(s)
+	sf.update(ev, func(s *SMTPSession) {
+		s.RcptTo = append(s.RcptTo, tr.Address)
+	})
 }
 
+func (sf *SessionTrackingMixin) TxData(fw FilterWrapper, ev FilterEvent) {
+	td, err := ev.TxData()
+	if err != nil {
+		skipEvent(ev, err)
+		return
+	}
+
+	if td.Result != "ok" {
+		return
+	}
+
+	sf.update(ev, func(s *SMTPSession) {
+		s.DataStartedAt = ev.GetTimestamp()
+		s.DataEndedAt = time.Time{}
+	})
+}
+
+/*
+ * Collects the message. At the end of the message it hands a snapshot of the
+ * session to MessageComplete, which the filter may keep using after the
+ * handler returned, or writes the message back. Filters implementing
+ * MessageStreamHandler get the message while it arrives instead.
+ */
 func (sf *SessionTrackingMixin) Dataline(fw FilterWrapper, ev FilterEvent) {
-	params := ev.GetParams()
-	if len(params) < 2 {
-		log.Fatal("invalid input, shouldn't happen")
+	dl, err := ev.DatalineRequest()
+	if err != nil {
+		skipEvent(ev, err)
+		sf.updateSession(ev.GetSessionId(), func(s *SMTPSession) {
+			if s.MessageError == nil {
+				s.MessageError = err
+			}
+		}, false)
+		return
+	}
+	line := dl.Line
+
+	if handler, ok := fw.GetFilter().(MessageStreamHandler); ok {
+		sf.streamDataline(handler, ev, line)
+		return
+	}
+
+	// only the end of the message changes fields that are stored
+	var snapshot *SMTPSession
+	known := sf.updateSession(ev.GetSessionId(), func(s *SMTPSession) {
+		if err := ev.GetError(); err != nil {
+			// keep the first error, the message is rejected at commit anyway
+			if s.MessageError == nil {
+				s.MessageError = err
+			}
+			return
+		}
+		if line == "." {
+			s.DataEndedAt = ev.GetTimestamp()
+			s.UpdatedAt = s.DataEndedAt
+			snapshot = s.Clone()
+			return
+		}
+		if s.MessageError != nil {
+			return
+		}
+		if s.Body == nil {
+			s.Body = newMessageBuffer(sf.limits)
+		}
+		// Input is raw SMTP data - unescape leading dots.
+		if err := s.Body.Append(strings.TrimPrefix(line, ".")); err != nil {
+			s.MessageError = err
+		}
+		s.Message = s.Body.Lines()
+		s.parsed = nil
+	}, line == ".")
+	if !known {
+		passDataline(ev, line)
+		return
+	}
+	if snapshot == nil {
+		return
+	}
+
+	if cb, ok := fw.GetFilter().(MessageReceivedCallback); ok {
+		cb.MessageComplete(&ev, snapshot)
+	} else {
+		ev.Responder().FlushMessage(snapshot)
+	}
+}
+
+/*
+ * Passes a data-line to the MessageStreamHandler, starting it on the first
+ * line of a message. A message that already failed before that, like one
+ * restored by SetStore, isn't handed to the handler.
+ */
+func (sf *SessionTrackingMixin) streamDataline(handler MessageStreamHandler, ev FilterEvent, line string) {
+	sessionId := ev.GetSessionId()
+	var stream *messageStream
+	// the message is rejected before the handler saw any of it
+	unhandled := false
+	known := sf.updateSession(sessionId, func(s *SMTPSession) {
+		if err := ev.GetError(); err != nil {
+			if s.MessageError == nil {
+				s.MessageError = err
+			}
+			return
+		}
+		if line == "." {
+			s.DataEndedAt = ev.GetTimestamp()
+			s.UpdatedAt = s.DataEndedAt
+		}
+		if s.stream == nil && s.MessageError != nil {
+			unhandled = line == "."
+			return
+		}
+		if s.stream == nil {
+			s.stream = startMessageStream(handler, s.Clone(), ev.Responder())
+		}
+		stream = s.stream
+		if line == "." {
+			s.stream = nil
+		}
+	}, line == ".")
+	if !known {
+		passDataline(ev, line)
+		return
+	}
+	if unhandled {
+		ev.Responder().DatalineEnd()
+		return
+	}
+	if stream == nil {
+		return
 	}
-	//token := params[0]
-	line := strings.Join(params[1:], "|")
 
-	s := sf.GetSession(ev.GetSessionId())
 	if line == "." {
-		if cb, ok := fw.GetFilter().(MessageReceivedCallback); ok {
-			sf.SetSession(s)
-			cb.MessageComplete(&ev, s)
-		} else {
-			ev.Responder().FlushMessage(s)
+		stream.end(func(err error) {
+			if err == nil {
+				return
+			}
+			sf.updateSession(sessionId, func(s *SMTPSession) {
+				if s.MessageError == nil {
+					s.MessageError = err
+				}
+			}, false)
+		})
+		return
+	}
+
+	var max int64
+	if sf.limits != nil {
+		max = sf.limits.MaxSize
+	}
+	// Input is raw SMTP data - unescape leading dots. Written outside of
+	// the session's lock, as it waits for the handler.
+	if err := stream.write(strings.TrimPrefix(line, "."), max); err != nil {
+		sf.updateSession(sessionId, func(s *SMTPSession) {
+			if s.MessageError == nil {
+				s.MessageError = err
+			}
+		}, false)
+	}
+}
+
+/*
+ * Writes a data-line of a session the mixin doesn't know back unchanged,
+ * like one that connected before the filter started or whose link-connect
+ * couldn't be parsed, so smtpd doesn't wait for the message forever.
+ */
+func passDataline(ev FilterEvent, line string) {
+	if line == "." {
+		ev.Responder().DatalineEnd()
+		return
+	}
+	// DatalineReply escapes the leading dot again
+	ev.Responder().DatalineReply(strings.TrimPrefix(line, "."))
+}
+
+/*
+ * Rejects the message if an error was recorded for it in the data phase,
+ * or its Body failed, with the reply of the ReplyError in the error's chain.
+ * Without one, or if its reply can't be sent, the message is rejected with
+ * 451 4.3.0. Filters
+ * that implement Commit themselves must check SMTPSession.MessageError and
+ * Body.Err().
+ */
+func (sf *SessionTrackingMixin) Commit(fw FilterWrapper, ev FilterEvent) {
+	var msgErr error
+	sf.updateSession(ev.GetSessionId(), func(s *SMTPSession) {
+		msgErr = s.MessageError
+		if msgErr == nil && s.Body != nil {
+			msgErr = s.Body.Err()
 		}
+	}, false)
+	if msgErr == nil {
+		ev.Responder().Proceed()
 		return
 	}
 
-	// Input is raw SMTP data - unescape leading dots.
-	line = strings.TrimPrefix(line, ".")
-	s.Message = append(s.Message, line)
-	sf.SetSession(s)
+	var re ReplyError
+	if errors.As(msgErr, &re) {
+		err := ev.Responder().Reject(re.Reply())
+		if err == nil {
+			return
+		}
+		log.Printf("rejecting message of session %s with the default reply: %v", ev.GetSessionId(), err)
+	}
+	_ = ev.Responder().Reject(messageErrorReply)
+}
+
+var messageErrorReply = Reply{
+	Code:     451,
+	Enhanced: "4.3.0",
+	Lines:    []string{"Message could not be processed"},
 }
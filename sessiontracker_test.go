@@ -0,0 +1,296 @@
+package opensmtpd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type trackingFilter struct {
+	SessionTrackingMixin
+}
+
+func (f *trackingFilter) GetName() string {
+	return "tracking"
+}
+
+/*
+ * Collects the lines a handler writes.
+ */
+type linePrinter struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (lp *linePrinter) SafePrintln(msg string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.lines = append(lp.lines, msg)
+}
+
+func (lp *linePrinter) Lines() []string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return append([]string(nil), lp.lines...)
+}
+
+func event(out Printer, line string) FilterEvent {
+	return NewFilterEvent(out, strings.Split(line, "|"))
+}
+
+func TestSessionTrackingSkipsUnparseableEvents(t *testing.T) {
+	f := &trackingFilter{}
+	fw := NewFilter(f)
+	out := &linePrinter{}
+
+	f.LinkConnect(fw, event(out, "report|0.7|1.5|smtp-in|link-connect|s1"))
+	if f.GetSession("s1") != nil {
+		t.Fatal("a session was created from an unparseable link-connect")
+	}
+
+	f.LinkConnect(fw, event(out, "report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25"))
+	f.TxMail(fw, event(out, "report|0.7|1.5|smtp-in|tx-mail|s1"))
+	if s := f.SnapshotSession("s1"); s == nil || s.MailFrom != "" {
+		t.Fatalf("unexpected session %+v", s)
+	}
+
+	f.Dataline(fw, event(out, "filter|0.7|1.5|smtp-in|data-line|s1|t1"))
+	if s := f.SnapshotSession("s1"); s.MessageError == nil {
+		t.Fatal("an unparseable data-line didn't fail the message")
+	}
+	f.Commit(fw, event(out, "filter|0.7|1.5|smtp-in|commit|s1|t2"))
+	want := "filter-result|s1|t2|reject|451 4.3.0 Message could not be processed"
+	if lines := out.Lines(); len(lines) != 1 || lines[0] != want {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+type replyError struct {
+	reply Reply
+}
+
+func (e *replyError) Error() string {
+	return "reply error"
+}
+
+func (e *replyError) Reply() Reply {
+	return e.reply
+}
+
+func TestCommitRejectsWithMessageError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"plain error", errors.New("failed"), "reject|451 4.3.0 Message could not be processed"},
+		{"reply error", &replyError{Reply{Code: 554, Lines: []string{"no"}}}, "reject|554 no"},
+		{"wrapped reply error", fmt.Errorf("scanning: %w", &replyError{Reply{Code: 554, Lines: []string{"no"}}}), "reject|554 no"},
+		{"invalid reply", &replyError{Reply{Code: 250, Lines: []string{"ok"}}}, "reject|451 4.3.0 Message could not be processed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &trackingFilter{}
+			fw := NewFilter(f)
+			out := &linePrinter{}
+			f.LinkConnect(fw, event(out, "report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25"))
+			f.UpdateSession("s1", func(s *SMTPSession) {
+				s.MessageError = tt.err
+			})
+
+			f.Commit(fw, event(out, "filter|0.7|1.5|smtp-in|commit|s1|t1"))
+			if want := "filter-result|s1|t1|" + tt.want; strings.Join(out.Lines(), "\n") != want {
+				t.Errorf("got %q, want %q", out.Lines(), want)
+			}
+		})
+	}
+}
+
+func TestRestoredSessionRejectsInterruptedMessage(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	collecting := &trackingFilter{}
+	streaming := &streamingFilter{release: release}
+	tests := []struct {
+		name   string
+		filter Filter
+		mixin  *SessionTrackingMixin
+	}{
+		{"collected", collecting, &collecting.SessionTrackingMixin},
+		{"streamed", streaming, &streaming.SessionTrackingMixin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemorySessionStore()
+			before := &trackingFilter{}
+			if err := before.SetStore(store, 0); err != nil {
+				t.Fatal(err)
+			}
+			out := &linePrinter{}
+			before.LinkConnect(NewFilter(before), event(out, "report|0.7|1.5|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25"))
+			before.UpdateSession("s1", func(s *SMTPSession) {
+				s.DataStartedAt = time.Unix(2, 0)
+			})
+
+			f := tt.mixin
+			fw := NewFilter(tt.filter)
+			if err := f.SetStore(store, 0); err != nil {
+				t.Fatal(err)
+			}
+			f.Dataline(fw, event(out, "filter|0.7|1.5|smtp-in|data-line|s1|t1|second half"))
+			f.Dataline(fw, event(out, "filter|0.7|1.5|smtp-in|data-line|s1|t1|."))
+			f.Commit(fw, event(out, "filter|0.7|1.5|smtp-in|commit|s1|t2"))
+
+			// the rest of the message isn't passed on
+			want := []string{
+				"filter-dataline|s1|t1|.",
+				"filter-result|s1|t2|reject|451 4.3.0 Message interrupted, please try again",
+			}
+			if got := out.Lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+/*
+ * Blocks saving the session called slow until release is closed.
+ */
+type slowStore struct {
+	*MemorySessionStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (ss *slowStore) Save(s *SMTPSession) error {
+	if s.Id == "slow" && s.HeloName != "" {
+		close(ss.saving)
+		<-ss.release
+	}
+	return ss.MemorySessionStore.Save(s)
+}
+
+func TestSlowSaveDoesNotBlockOtherSessions(t *testing.T) {
+	store := &slowStore{NewMemorySessionStore(), make(chan struct{}), make(chan struct{})}
+	holder := &SessionHolderImpl{}
+	if err := holder.SetStore(store, 0); err != nil {
+		t.Fatal(err)
+	}
+	holder.SetSession(&SMTPSession{Id: "slow"})
+	holder.SetSession(&SMTPSession{Id: "fast"})
+
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		holder.UpdateSession("slow", func(s *SMTPSession) {
+			s.HeloName = "slow.example.org"
+		})
+	}()
+	<-store.saving
+
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		holder.UpdateSession("fast", func(s *SMTPSession) {
+			s.HeloName = "fast.example.org"
+		})
+		holder.SnapshotSession("fast")
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("saving one session held up another")
+	}
+
+	close(store.release)
+	<-saved
+	if s := holder.SnapshotSession("slow"); s.HeloName != "slow.example.org" {
+		t.Errorf("unexpected session %+v", s)
+	}
+}
+
+func TestCloneSharesNoMemory(t *testing.T) {
+	s := &SMTPSession{Id: "s1", RcptTo: make([]string, 1, 4), Message: make([]string, 1, 4)}
+	c := s.Clone()
+	c.RcptTo[0] = "changed"
+	c.RcptTo = append(c.RcptTo, "added")
+	c.Message[0] = "changed"
+	s.RcptTo = append(s.RcptTo, "original")
+
+	if s.RcptTo[0] != "" || s.Message[0] != "" || c.RcptTo[1] != "added" {
+		t.Errorf("the clone shares memory: %q %q, %q", s.RcptTo, s.Message, c.RcptTo)
+	}
+}
+
+func TestUnknownSessionDatalinesPassThrough(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	collecting := &trackingFilter{}
+	streaming := &streamingFilter{release: release}
+	tests := []struct {
+		name    string
+		filter  Filter
+		mixin   *SessionTrackingMixin
+		connect string
+	}{
+		{"unknown session", collecting, &collecting.SessionTrackingMixin, ""},
+		{"bad link-connect", collecting, &collecting.SessionTrackingMixin, "report|0.7|1.5|smtp-in|link-connect|s9"},
+		{"unknown session streamed", streaming, &streaming.SessionTrackingMixin, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.mixin
+			fw := NewFilter(tt.filter)
+			out := &linePrinter{}
+			if tt.connect != "" {
+				f.LinkConnect(fw, event(out, tt.connect))
+			}
+			f.Dataline(fw, event(out, "filter|0.7|1.5|smtp-in|data-line|s9|t1|hello"))
+			f.Dataline(fw, event(out, "filter|0.7|1.5|smtp-in|data-line|s9|t1|..dot"))
+			f.Dataline(fw, event(out, "filter|0.7|1.5|smtp-in|data-line|s9|t1|."))
+
+			want := []string{
+				"filter-dataline|s9|t1|hello",
+				"filter-dataline|s9|t1|..dot",
+				"filter-dataline|s9|t1|.",
+			}
+			if got := out.Lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSessionTimings(t *testing.T) {
+	f := &trackingFilter{}
+	fw := NewFilter(f)
+	out := &linePrinter{}
+	f.LinkConnect(fw, event(out, "report|0.7|100.25|smtp-in|link-connect|s1|rdns|pass|192.0.2.1:25|192.0.2.2:25"))
+	f.TxMail(fw, event(out, "report|0.7|101|smtp-in|tx-mail|s1|m1|ok|sender@example.org"))
+	f.TxMail(fw, event(out, "report|0.7|102|smtp-in|tx-mail|s1|m2|ok|other@example.org"))
+	f.TxData(fw, event(out, "report|0.7|103|smtp-in|tx-data|s1|m2|ok"))
+
+	s := f.SnapshotSession("s1")
+	if got := s.TimeToMailFrom(); got != 750*time.Millisecond {
+		t.Errorf("TimeToMailFrom: got %v, want 750ms", got)
+	}
+	if got := s.DataDuration(); got != 0 {
+		t.Errorf("DataDuration of an incomplete message: got %v, want 0", got)
+	}
+
+	f.Dataline(fw, event(out, "filter|0.7|104.5|smtp-in|data-line|s1|t1|."))
+	s = f.SnapshotSession("s1")
+	if got := s.DataDuration(); got != 1500*time.Millisecond {
+		t.Errorf("DataDuration: got %v, want 1.5s", got)
+	}
+	if got := s.ConnectedFor(event(out, "filter|0.7|110.25|smtp-in|commit|s1|t2")); got != 10*time.Second {
+		t.Errorf("ConnectedFor: got %v, want 10s", got)
+	}
+
+	if got := (&SMTPSession{}).TimeToMailFrom(); got != 0 {
+		t.Errorf("TimeToMailFrom without MAIL FROM: got %v, want 0", got)
+	}
+}
@@ -0,0 +1,92 @@
+package opensmtpd_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	opensmtpd "github.com/jdelic/opensmtpd-filters-go"
+	"github.com/jdelic/opensmtpd-filters-go/opensmtpdtest"
+)
+
+/*
+ * Hands every message to a goroutine that keeps using the session while
+ * the next events arrive. Run with -race.
+ */
+type racingFilter struct {
+	opensmtpd.SessionTrackingMixin
+
+	wg         sync.WaitGroup
+	messages   atomic.Int32
+	incomplete atomic.Int32
+}
+
+func (f *racingFilter) GetName() string {
+	return "racing"
+}
+
+func (f *racingFilter) MessageComplete(ev *opensmtpd.FilterEvent, session *opensmtpd.SMTPSession) {
+	f.messages.Add(1)
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		c := session.Clone()
+		if len(c.RcptTo) != 3 || c.Body == nil || c.Body.Size() == 0 {
+			f.incomplete.Add(1)
+		}
+		f.UpdateSession(session.Id, func(s *opensmtpd.SMTPSession) {
+			s.MailFrom = strings.ToUpper(s.MailFrom)
+		})
+		f.SnapshotSession(session.Id)
+	}()
+	(*ev).Responder().FlushMessage(session)
+}
+
+func TestSessionTrackingWithWorkers(t *testing.T) {
+	f := &racingFilter{}
+	f.SetMessageLimits(&opensmtpd.MessageLimits{MaxTotalMemory: 16 * 1024, TempDir: t.TempDir()})
+	input := opensmtpdtest.GenerateInput(opensmtpdtest.Workload{Sessions: 50, Recipients: 3, MessageLines: 100})
+
+	stop := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for id, s := range f.SnapshotSessions() {
+				f.UpdateSession(id, func(s *opensmtpd.SMTPSession) {
+					s.UserName = "watcher"
+				})
+				s.Clone()
+			}
+		}
+	}()
+
+	err := opensmtpd.NewRuntime(opensmtpd.NewFilter(f), bytes.NewReader(input), io.Discard,
+		opensmtpd.WithWorkers(8)).Run(context.Background())
+	close(stop)
+	<-watched
+	f.wg.Wait()
+
+	if !errors.Is(err, opensmtpd.ErrInputClosed) {
+		t.Fatalf("expected ErrInputClosed, got %v", err)
+	}
+	if n := f.messages.Load(); n != 50 {
+		t.Errorf("expected 50 messages, got %d", n)
+	}
+	if n := f.incomplete.Load(); n != 0 {
+		t.Errorf("%d snapshots were incomplete", n)
+	}
+	if sessions := f.SnapshotSessions(); len(sessions) != 0 {
+		t.Errorf("%d sessions weren't deleted", len(sessions))
+	}
+}
@@ -0,0 +1,212 @@
+package opensmtpd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TranscriptInput  = "<"
+	TranscriptOutput = ">"
+)
+
+/*
+ * Records every line the Runtime reads and writes to w, one per line as
+ * "<RFC 3339 timestamp>\t<direction>\t<line>". The direction is "<" for
+ * lines from OpenSMTPD and ">" for lines to it. Replay reads this format.
+ */
+func WithTranscript(w io.Writer) RuntimeOption {
+	return func(rt *Runtime) {
+		rec := &transcriptRecorder{w: w}
+		rt.in = &transcriptTee{r: rt.in, rec: rec, direction: TranscriptInput}
+		rt.out = &transcriptTee{w: rt.out, rec: rec, direction: TranscriptOutput}
+	}
+}
+
+type transcriptRecorder struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (tr *transcriptRecorder) record(direction string, line []byte) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.err != nil {
+		return
+	}
+	_, tr.err = fmt.Fprintf(tr.w, "%s\t%s\t%s\n",
+		time.Now().UTC().Format(time.RFC3339Nano), direction, line)
+}
+
+/*
+ * Passes data through to the wrapped reader or writer and records every
+ * complete line.
+ */
+type transcriptTee struct {
+	r         io.Reader
+	w         io.Writer
+	rec       *transcriptRecorder
+	direction string
+	partial   []byte
+}
+
+func (tt *transcriptTee) Read(p []byte) (int, error) {
+	n, err := tt.r.Read(p)
+	tt.split(p[:n])
+	return n, err
+}
+
+func (tt *transcriptTee) Write(p []byte) (int, error) {
+	n, err := tt.w.Write(p)
+	tt.split(p[:n])
+	return n, err
+}
+
+func (tt *transcriptTee) split(data []byte) {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			tt.partial = append(tt.partial, data...)
+			return
+		}
+		line := append(tt.partial, data[:i]...)
+		tt.rec.record(tt.direction, line)
+		tt.partial = tt.partial[:0]
+		data = data[i+1:]
+	}
+}
+
+/*
+ * A response that differs between a transcript and its replay. Key is the
+ * session id and token the response belongs to, Index its position among
+ * the responses for that key. Recorded or Replayed is empty if the response
+ * is missing on that side.
+ */
+type ReplayDiff struct {
+	Key      string
+	Index    int
+	Recorded string
+	Replayed string
+}
+
+func (rd ReplayDiff) String() string {
+	return fmt.Sprintf("%s #%d: recorded %q, replayed %q", rd.Key, rd.Index, rd.Recorded, rd.Replayed)
+}
+
+/*
+ * Feeds the input lines of a transcript recorded with WithTranscript to fw
+ * and compares its responses to the recorded ones. Responses are compared
+ * per session and token, so the order of responses of different sessions
+ * doesn't matter, and registrations are compared regardless of their order.
+ * A last line without a line break, as left by a filter that was stopped
+ * while it was recording, is ignored. Returns nil if the responses match.
+ */
+func Replay(ctx context.Context, fw FilterWrapper, transcript io.Reader, opts ...RuntimeOption) ([]ReplayDiff, error) {
+	var input bytes.Buffer
+	var recorded []string
+
+	reader := bufio.NewReaderSize(transcript, 64*1024)
+	for {
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			// the transcript is cut off, the line may be incomplete
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("opensmtpd: reading transcript: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("opensmtpd: invalid transcript line %q", line)
+		}
+		switch fields[1] {
+		case TranscriptInput:
+			input.WriteString(fields[2])
+			input.WriteByte('\n')
+		case TranscriptOutput:
+			recorded = append(recorded, fields[2])
+		default:
+			return nil, fmt.Errorf("opensmtpd: invalid transcript direction %q", fields[1])
+		}
+	}
+
+	var output bytes.Buffer
+	err := NewRuntime(fw, &input, &output, opts...).Run(ctx)
+	if !errors.Is(err, ErrInputClosed) {
+		return nil, err
+	}
+
+	replayed := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if output.Len() == 0 {
+		replayed = nil
+	}
+	return diffResponses(recorded, replayed), nil
+}
+
+func diffResponses(recorded, replayed []string) []ReplayDiff {
+	var keys []string
+	rec := groupResponses(recorded, &keys)
+	rep := groupResponses(replayed, &keys)
+
+	var diffs []ReplayDiff
+	for _, key := range keys {
+		a, b := rec[key], rep[key]
+		for i := 0; i < len(a) || i < len(b); i++ {
+			var x, y string
+			if i < len(a) {
+				x = a[i]
+			}
+			if i < len(b) {
+				y = b[i]
+			}
+			if x != y {
+				diffs = append(diffs, ReplayDiff{Key: key, Index: i, Recorded: x, Replayed: y})
+			}
+		}
+	}
+	return diffs
+}
+
+/*
+ * Groups response lines by the session id and token they contain. Keys are
+ * appended to keys in the order they first appear.
+ */
+func groupResponses(lines []string, keys *[]string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, line := range lines {
+		key := "register"
+		if !strings.HasPrefix(line, "register|") {
+			atoms := strings.SplitN(line, "|", 4)
+			if len(atoms) >= 3 {
+				key = atoms[1] + "|" + atoms[2]
+			}
+		}
+		if _, ok := groups[key]; !ok && !contains(*keys, key) {
+			*keys = append(*keys, key)
+		}
+		groups[key] = append(groups[key], line)
+	}
+	// registrations are printed in map order
+	sort.Strings(groups["register"])
+	return groups
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package opensmtpd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const transcriptInput = "config|ready\n" +
+	"filter|0.7|1.5|smtp-in|helo|s1|t1|example.org\n" +
+	"filter|0.7|1.5|smtp-in|helo|s2|t2|example.com\n" +
+	"filter|0.7|1.5|smtp-in|helo|s1|t3|example.net\n"
+
+func rejectOn(phase string) FilterWrapper {
+	return NewFilter(nil).OnFilter(phase, func(fw FilterWrapper, ev FilterEvent) {
+		ev.Responder().SoftReject("try later")
+	})
+}
+
+/*
+ * Returns the lines of a transcript in direction, with registrations
+ * sorted, as they're printed in map order.
+ */
+func transcriptLines(t *testing.T, transcript, direction string) []string {
+	t.Helper()
+	var lines, registrations []string
+	for _, line := range strings.Split(strings.TrimSuffix(transcript, "\n"), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			t.Fatalf("invalid transcript line %q", line)
+		}
+		switch {
+		case fields[1] != direction:
+		case strings.HasPrefix(fields[2], "register|") && fields[2] != "register|ready":
+			registrations = append(registrations, fields[2])
+		default:
+			lines = append(lines, fields[2])
+		}
+	}
+	sort.Strings(registrations)
+	return append(registrations, lines...)
+}
+
+func record(t *testing.T, fw FilterWrapper) string {
+	t.Helper()
+	var transcript, out bytes.Buffer
+	err := NewRuntime(fw, strings.NewReader(transcriptInput), &out, WithTranscript(&transcript)).Run(context.Background())
+	if !errors.Is(err, ErrInputClosed) {
+		t.Fatal(err)
+	}
+	return transcript.String()
+}
+
+func TestTranscriptRoundTrip(t *testing.T) {
+	recorded := record(t, proceedOn("helo"))
+	if got := transcriptLines(t, recorded, TranscriptInput); strings.Join(got, "\n")+"\n" != transcriptInput {
+		t.Errorf("recorded input %q, want %q", got, transcriptInput)
+	}
+
+	var replayed bytes.Buffer
+	diffs, err := Replay(context.Background(), proceedOn("helo"), strings.NewReader(recorded), WithTranscript(&replayed))
+	if err != nil || len(diffs) != 0 {
+		t.Fatalf("unexpected diffs %v, %v", diffs, err)
+	}
+	want := transcriptLines(t, recorded, TranscriptOutput)
+	if got := transcriptLines(t, replayed.String(), TranscriptOutput); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("replayed %q, recorded %q", got, want)
+	}
+	if len(want) != 5 {
+		t.Errorf("expected a registration, register|ready and 3 results, got %q", want)
+	}
+}
+
+func TestReplayReportsChangedResponses(t *testing.T) {
+	diffs, err := Replay(context.Background(), rejectOn("helo"), strings.NewReader(record(t, proceedOn("helo"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 3 {
+		t.Fatalf("expected 3 diffs, got %v", diffs)
+	}
+	want := ReplayDiff{
+		Key:      "s1|t1",
+		Recorded: "filter-result|s1|t1|proceed",
+		Replayed: "filter-result|s1|t1|reject|451 try later",
+	}
+	if diffs[0] != want {
+		t.Errorf("got %v, want %v", diffs[0], want)
+	}
+}
+
+func TestReplayTruncatedTranscript(t *testing.T) {
+	recorded := record(t, proceedOn("helo"))
+	// cut off in the middle of the last response
+	truncated := recorded[:len(recorded)-10]
+
+	diffs, err := Replay(context.Background(), proceedOn("helo"), strings.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReplayDiff{Key: "s1|t3", Replayed: "filter-result|s1|t3|proceed"}
+	if len(diffs) != 1 || diffs[0] != want {
+		t.Errorf("got %v, want %v", diffs, want)
+	}
+
+	// a complete line that isn't a transcript line is still an error
+	if _, err := Replay(context.Background(), proceedOn("helo"), strings.NewReader(recorded+"garbage\n")); err == nil {
+		t.Error("expected an error for an invalid line")
+	}
+}